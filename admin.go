@@ -0,0 +1,159 @@
+package adblockr
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminSource = "admin"
+
+type AdminServer struct {
+	address    string
+	token      string
+	server     *Server
+	refresh    func() error
+	httpServer *http.Server
+}
+
+type adminResponse struct {
+	Ok    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// NewAdminServer creates the admin HTTP API of a running server,
+// every request must carry the token as `Authorization: Bearer <token>`.
+func NewAdminServer(address string, token string, server *Server, refresh func() error) *AdminServer {
+	a := &AdminServer{
+		address: address,
+		token:   token,
+		server:  server,
+		refresh: refresh,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blacklist", a.handleBucket(false))
+	mux.HandleFunc("/whitelist", a.handleBucket(true))
+	mux.HandleFunc("/cache/flush", a.handleFlush)
+	mux.HandleFunc("/refresh", a.handleRefresh)
+	mux.HandleFunc("/check", a.handleCheck)
+
+	a.httpServer = &http.Server{
+		Addr:         address,
+		Handler:      a.authorize(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Minute,
+	}
+	return a
+}
+
+func (a *AdminServer) ListenAndServe() {
+	log.WithField("listen", a.address).Info("admin api ready for connection")
+	if err := a.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("admin api server error")
+	}
+}
+
+func (a *AdminServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = a.httpServer.Shutdown(ctx)
+}
+
+func (a *AdminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeAdminResponse(w, http.StatusUnauthorized, adminResponse{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminServer) handleBucket(whitelist bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := a.server.Blacklist()
+		if whitelist {
+			bucket = a.server.Whitelist()
+		}
+
+		rule, ok, err := ParseRule(r.FormValue("rule"))
+		if err != nil || !ok {
+			writeAdminResponse(w, http.StatusBadRequest, adminResponse{Error: "invalid or missing rule"})
+			return
+		}
+		rule.Exception = whitelist
+		rule.Source = adminSource
+
+		logCtx := log.WithFields(log.Fields{"rule": rule.String(), "whitelist": whitelist})
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+			if err := bucket.Put(rule); err != nil {
+				writeAdminResponse(w, http.StatusBadRequest, adminResponse{Error: err.Error()})
+				return
+			}
+			logCtx.Info("rule added from admin api")
+		case http.MethodDelete:
+			bucket.Forget(rule.Key)
+			logCtx.Info("rule removed from admin api")
+		default:
+			writeAdminResponse(w, http.StatusMethodNotAllowed, adminResponse{Error: "method not allowed"})
+			return
+		}
+		a.server.FlushCache()
+		writeAdminResponse(w, http.StatusOK, adminResponse{Ok: true, Data: rule.String()})
+	}
+}
+
+func (a *AdminServer) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminResponse(w, http.StatusMethodNotAllowed, adminResponse{Error: "method not allowed"})
+		return
+	}
+	a.server.FlushCache()
+	log.Info("cache flushed from admin api")
+	writeAdminResponse(w, http.StatusOK, adminResponse{Ok: true})
+}
+
+func (a *AdminServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminResponse(w, http.StatusMethodNotAllowed, adminResponse{Error: "method not allowed"})
+		return
+	}
+	if a.refresh == nil {
+		writeAdminResponse(w, http.StatusNotImplemented, adminResponse{Error: "refresh is not available"})
+		return
+	}
+	log.Info("sources refresh requested from admin api")
+	if err := a.refresh(); err != nil {
+		writeAdminResponse(w, http.StatusInternalServerError, adminResponse{Error: err.Error()})
+		return
+	}
+	a.server.FlushCache()
+	writeAdminResponse(w, http.StatusOK, adminResponse{Ok: true})
+}
+
+func (a *AdminServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	domain := unFqdn(strings.TrimSpace(r.FormValue("domain")))
+	if domain == "" {
+		writeAdminResponse(w, http.StatusBadRequest, adminResponse{Error: "missing domain"})
+		return
+	}
+	verdict := a.server.Check(domain)
+	if client := r.FormValue("client"); client != "" {
+		verdict = a.server.CheckClient(domain, client)
+	}
+	writeAdminResponse(w, http.StatusOK, adminResponse{Ok: true, Data: verdict})
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, resp adminResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
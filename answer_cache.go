@@ -0,0 +1,44 @@
+package adblockr
+
+import (
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+// AnswerCache keeps the answers of a server by question.
+type AnswerCache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, d time.Duration)
+	Entries() map[string]CacheEntry
+	ItemCount() int
+	Flush()
+}
+
+// CacheEntry is an answer of an AnswerCache, a zero Expiration never expires.
+type CacheEntry struct {
+	Value      interface{}
+	Expiration time.Time
+}
+
+// goCache is the default AnswerCache, a go-cache without a size limit.
+type goCache struct {
+	*cache.Cache
+}
+
+func newGoCache(defaultExpiration time.Duration, cleanupInterval time.Duration) *goCache {
+	return &goCache{cache.New(defaultExpiration, cleanupInterval)}
+}
+
+// Entries returns a copy of all answers which did not expire yet.
+func (c *goCache) Entries() map[string]CacheEntry {
+	items := c.Items()
+	entries := make(map[string]CacheEntry, len(items))
+	for key, item := range items {
+		entry := CacheEntry{Value: item.Object}
+		if item.Expiration > 0 {
+			entry.Expiration = time.Unix(0, item.Expiration)
+		}
+		entries[key] = entry
+	}
+	return entries
+}
@@ -0,0 +1,131 @@
+package adblockr
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const answerCacheBucket = "answer_cache"
+
+// CacheItem is a cached answer as persisted between restarts, all times are absolute.
+type CacheItem struct {
+	Key    string        `json:"key"`
+	Msg    []byte        `json:"msg"`
+	Stored time.Time     `json:"stored"`
+	Expire time.Time     `json:"expire"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	Until  time.Time     `json:"until"`
+	Result string        `json:"result,omitempty"`
+	Rule   string        `json:"rule,omitempty"`
+	Source string        `json:"source,omitempty"`
+	CNAME  string        `json:"cname,omitempty"`
+	IP     string        `json:"ip,omitempty"`
+}
+
+// CacheStore persists the answer cache of a server across restarts.
+type CacheStore interface {
+	LoadCache() ([]CacheItem, error)
+	SaveCache(items []CacheItem) error
+}
+
+type fileCacheStore struct {
+	filepath string
+}
+
+// NewFileCacheStore keeps the answer cache in a JSON file.
+func NewFileCacheStore(filepath string) CacheStore {
+	return &fileCacheStore{filepath: filepath}
+}
+
+func (f *fileCacheStore) LoadCache() ([]CacheItem, error) {
+	data, err := ioutil.ReadFile(f.filepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []CacheItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (f *fileCacheStore) SaveCache(items []CacheItem) error {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.filepath), "cache-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.filepath)
+}
+
+type dbCacheStore struct {
+	db   *bolt.DB
+	name []byte
+}
+
+// CacheStore keeps the answer cache in a separate bucket of the database file.
+func (s *DbDomainBucket) CacheStore() CacheStore {
+	return &dbCacheStore{db: s.db.DB, name: []byte(s.prefix + answerCacheBucket)}
+}
+
+func (d *dbCacheStore) LoadCache() ([]CacheItem, error) {
+	var items []CacheItem
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(d.name)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var item CacheItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (d *dbCacheStore) SaveCache(items []CacheItem) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(d.name) != nil {
+			if err := tx.DeleteBucket(d.name); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket(d.name)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(item.Key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,160 @@
+package adblockr
+
+import (
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"time"
+)
+
+// cachedAnswer is a reply stored in the answer cache together with the time it was stored,
+// it is never written to clients directly, every hit gets its own copy.
+type cachedAnswer struct {
+	msg        *dns.Msg
+	stored     time.Time
+	expire     time.Time
+	ttl        time.Duration // zero unless the answer can be refreshed from upstream
+	result     string        // result of the query counted in the metrics on every hit
+	rule       string        // rule, source, cname and ip of a blocked answer for the query log
+	source     string
+	cname      string
+	ip         string
+	hits       uint32
+	refreshing int32
+	failed     int64 // unix nano of the last failed lookup while stale
+	staleBusy  int32
+}
+
+func newCachedAnswer(m *dns.Msg, ttl time.Duration, result string) *cachedAnswer {
+	now := time.Now()
+	return &cachedAnswer{msg: m, stored: now, expire: now.Add(ttl), result: result}
+}
+
+// logBlock copies why a cached answer was blocked into a query log entry.
+func (c *cachedAnswer) logBlock(entry *QueryLogEntry) {
+	entry.Rule, entry.Source, entry.CNAME, entry.IP = c.rule, c.source, c.cname, c.ip
+}
+
+func (c *cachedAnswer) expired() bool {
+	return time.Now().After(c.expire)
+}
+
+func (c *cachedAnswer) hit() {
+	atomic.AddUint32(&c.hits, 1)
+}
+
+// shouldPrefetch reports whether a popular answer has less than threshold of its ttl left,
+// it returns true only once per answer so a single refresh is started.
+func (c *cachedAnswer) shouldPrefetch(threshold float64, minHits uint32) bool {
+	if c.ttl <= 0 || threshold <= 0 || atomic.LoadUint32(&c.hits) < minHits {
+		return false
+	}
+	remaining := c.ttl - time.Since(c.stored)
+	if remaining > time.Duration(float64(c.ttl)*threshold) {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&c.refreshing, 0, 1)
+}
+
+// prefetchFailed allows another prefetch of an answer whose refresh failed or was not started.
+func (c *cachedAnswer) prefetchFailed() {
+	atomic.StoreInt32(&c.refreshing, 0)
+}
+
+// lookupFailed records that the upstreams could not refresh this stale answer.
+func (c *cachedAnswer) lookupFailed() {
+	atomic.StoreInt64(&c.failed, time.Now().UnixNano())
+}
+
+// recentlyFailed reports whether refreshing this stale answer failed during the last StaleTTL,
+// clients are then answered from the cache right away instead of waiting for the upstreams again.
+func (c *cachedAnswer) recentlyFailed() bool {
+	failed := atomic.LoadInt64(&c.failed)
+	return failed > 0 && time.Since(time.Unix(0, failed)) < time.Duration(StaleTTL)*time.Second
+}
+
+// startStaleRefresh reports whether the caller should refresh the stale answer, only one refresh runs at a time.
+func (c *cachedAnswer) startStaleRefresh() bool {
+	return atomic.CompareAndSwapInt32(&c.staleBusy, 0, 1)
+}
+
+func (c *cachedAnswer) staleRefreshDone() {
+	atomic.StoreInt32(&c.staleBusy, 0)
+}
+
+// staleReply returns a copy of an expired answer for request r with every TTL set to StaleTTL (RFC 8767).
+func (c *cachedAnswer) staleReply(network string, r *dns.Msg) *dns.Msg {
+	m := c.reply(network, r)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = StaleTTL
+			}
+		}
+	}
+	return m
+}
+
+// reply returns a copy of the cached answer for request r, with the TTLs decremented by the
+// time spent in the cache and the header, DNSSEC records and EDNS0 matching the request.
+func (c *cachedAnswer) reply(network string, r *dns.Msg) *dns.Msg {
+	m := c.msg.Copy()
+	m.Id = r.Id
+	m.Question = append([]dns.Question(nil), r.Question...)
+	m.RecursionDesired = r.RecursionDesired
+	m.CheckingDisabled = r.CheckingDisabled
+
+	elapsed := uint32(time.Since(c.stored) / time.Second)
+	opt := r.IsEdns0()
+	dnssec := opt != nil && opt.Do()
+	if !dnssec && !r.AuthenticatedData {
+		m.AuthenticatedData = false
+	}
+
+	qType := dns.TypeNone
+	if len(r.Question) > 0 {
+		qType = r.Question[0].Qtype
+	}
+	m.Answer = decayRecords(m.Answer, elapsed, dnssec, qType)
+	m.Ns = decayRecords(m.Ns, elapsed, dnssec, qType)
+	m.Extra = decayRecords(m.Extra, elapsed, dnssec, qType)
+
+	size := dns.MinMsgSize
+	if opt != nil {
+		udpSize := uint16(dns.DefaultMsgSize)
+		if cachedOpt := c.msg.IsEdns0(); cachedOpt != nil {
+			udpSize = cachedOpt.UDPSize()
+		}
+		m.SetEdns0(udpSize, dnssec)
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	}
+	if network == "udp" {
+		m.Truncate(size)
+	}
+	return m
+}
+
+// decayRecords decrements the TTL of every record by elapsed seconds, drops the OPT record
+// and, unless the client asked for them, the DNSSEC records.
+func decayRecords(rrs []dns.RR, elapsed uint32, dnssec bool, qType uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeOPT:
+			continue
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if !dnssec && hdr.Rrtype != qType {
+				continue
+			}
+		}
+		if hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+		out = append(out, rr)
+	}
+	return out
+}
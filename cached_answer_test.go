@@ -0,0 +1,136 @@
+package adblockr
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func newTestMsg(t *testing.T, records ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestCachedAnswerReply(t *testing.T) {
+	cached := newTestMsg(t,
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 20 IN A 192.0.2.2",
+		"example.com. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 12345 example.com. AAAA",
+	)
+	answer := newCachedAnswer(cached, time.Minute, resultAllowed)
+	answer.stored = time.Now().Add(-30 * time.Second)
+
+	tests := []struct {
+		name     string
+		dnssec   bool
+		cd       bool
+		wantTTLs []uint32
+	}{
+		{"plain", false, false, []uint32{270, 0}},
+		{"dnssec", true, false, []uint32{270, 0, 270}},
+		{"checking disabled", false, true, []uint32{270, 0}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("Example.COM.", dns.TypeA)
+		r.CheckingDisabled = tt.cd
+		if tt.dnssec {
+			r.SetEdns0(4096, true)
+		}
+		m := answer.reply("udp", r)
+
+		if m.Id != r.Id || m.Question[0].Name != "Example.COM." || m.CheckingDisabled != tt.cd {
+			t.Errorf("%s: header not copied from the request: %v", tt.name, m.MsgHdr)
+		}
+		if len(m.Answer) != len(tt.wantTTLs) {
+			t.Fatalf("%s: %d answers, want %d: %v", tt.name, len(m.Answer), len(tt.wantTTLs), m.Answer)
+		}
+		for i, rr := range m.Answer {
+			if rr.Header().Ttl != tt.wantTTLs[i] {
+				t.Errorf("%s: ttl of %v = %d, want %d", tt.name, rr, rr.Header().Ttl, tt.wantTTLs[i])
+			}
+		}
+		if opt := m.IsEdns0(); (opt != nil) != tt.dnssec || opt != nil && !opt.Do() {
+			t.Errorf("%s: edns0 %v does not match the request", tt.name, opt)
+		}
+	}
+
+	if cached.Answer[0].Header().Ttl != 300 || len(cached.Answer) != 3 {
+		t.Errorf("cached message modified by reply: %v", cached.Answer)
+	}
+}
+
+func TestCachedAnswerReplyTruncates(t *testing.T) {
+	var records []string
+	for i := 0; i < 40; i++ {
+		records = append(records, "example.com. 300 IN TXT \"a long text record to fill the udp answer of the test\"")
+	}
+	answer := newCachedAnswer(newTestMsg(t, records...), time.Minute, resultAllowed)
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	if m := answer.reply("udp", r); !m.Truncated || m.Len() > dns.MinMsgSize {
+		t.Errorf("udp reply truncated = %v, size %d, want truncated to %d", m.Truncated, m.Len(), dns.MinMsgSize)
+	}
+	if m := answer.reply("tcp", r); m.Truncated || len(m.Answer) != len(records) {
+		t.Errorf("tcp reply truncated = %v with %d answers, want all %d", m.Truncated, len(m.Answer), len(records))
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		dnssec bool
+		cd     bool
+		want   string
+	}{
+		{false, false, "example.com A IN"},
+		{true, false, "example.com A IN do"},
+		{false, true, "example.com A IN cd"},
+		{true, true, "example.com A IN do cd"},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.CheckingDisabled = tt.cd
+		if tt.dnssec {
+			r.SetEdns0(4096, true)
+		}
+		if got := cacheKey(r); got != tt.want {
+			t.Errorf("cacheKey(do %v, cd %v) = %q, want %q", tt.dnssec, tt.cd, got, tt.want)
+		}
+	}
+}
+
+func TestCachedAnswerPrefetch(t *testing.T) {
+	answer := newCachedAnswer(newTestMsg(t, "example.com. 100 IN A 192.0.2.1"), 100*time.Second, resultAllowed)
+	answer.ttl = 100 * time.Second
+	answer.hit()
+	answer.hit()
+
+	if answer.shouldPrefetch(0.1, 2) {
+		t.Error("prefetch of a fresh answer")
+	}
+	answer.stored = time.Now().Add(-95 * time.Second)
+	if answer.shouldPrefetch(0.1, 3) {
+		t.Error("prefetch of an answer with too few hits")
+	}
+	if !answer.shouldPrefetch(0.1, 2) {
+		t.Fatal("no prefetch of a popular answer about to expire")
+	}
+	if answer.shouldPrefetch(0.1, 2) {
+		t.Error("second prefetch while the first one runs")
+	}
+	answer.prefetchFailed()
+	if !answer.shouldPrefetch(0.1, 2) {
+		t.Error("no prefetch after a failed one")
+	}
+}
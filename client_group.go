@@ -0,0 +1,80 @@
+package adblockr
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BlockMode is the answer given for a blocked query.
+type BlockMode int
+
+const (
+	BlockDefault BlockMode = iota
+	BlockNullRoute
+	BlockNXDomain
+)
+
+func ParseBlockMode(mode string) (BlockMode, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return BlockDefault, nil
+	case "null", "nullroute":
+		return BlockNullRoute, nil
+	case "nxdomain":
+		return BlockNXDomain, nil
+	default:
+		return BlockDefault, fmt.Errorf("invalid block mode: %s", mode)
+	}
+}
+
+func (m BlockMode) nxDomain() bool {
+	if m == BlockDefault {
+		return RejectWithNXDomain
+	}
+	return m == BlockNXDomain
+}
+
+// ClientGroup is the policy of the clients within its networks. A nil Blacklist uses the blacklist of
+// the server, the Whitelist is checked in addition to the whitelist of the server.
+type ClientGroup struct {
+	Name      string
+	Networks  []*net.IPNet
+	Blacklist DomainBucket
+	Whitelist DomainBucket
+	BlockMode BlockMode
+}
+
+// ParseNetworks parses a list of IP addresses and CIDRs.
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (g *ClientGroup) contains(ip net.IP) bool {
+	for _, network := range g.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"github.com/frengky/adblockr"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// blacklistStore holds the rules downloaded from the blacklist sources,
+// exceptions of the sources are kept apart from the configured whitelist.
+type blacklistStore struct {
+	blacklist  adblockr.DomainBucket
+	exceptions adblockr.DomainBucket
+	cache      adblockr.CacheStore
+	close      func() error
+}
+
+func initBlacklistFromSources(sources []SourceConfig, store adblockr.DomainBucket, exceptions adblockr.DomainBucket) (int, int) {
+	log.Info("initializing blacklist database, may take a while...")
+
+	httpClient := adblockr.NewHttpClient(config.Nameservers[0], dnsTimeoutMs, httpTimeoutSecs)
+	total := 0
+	source := 0
+	failed := 0
+
+	for _, src := range sources {
+		uri := src.Uri
+		source++
+		log.WithFields(log.Fields{"uri": uri, "mode": src.MatchMode()}).Info("processing sources")
+		func() {
+			list, err := openSource(uri, httpClient)
+			if err != nil {
+				failed++
+				log.WithField("uri", uri).WithError(err).Errorf("download failed")
+				return
+			}
+			defer list.Close()
+
+			count, err := adblockr.LoadRules(list, uri, src.MatchMode(), store, exceptions)
+			if err != nil {
+				failed++
+				log.WithField("uri", uri).WithError(err).Errorf("download failed")
+				return
+			}
+			log.WithField("uri", uri).WithField("count", count).Info("download success")
+			total = total + count
+		}()
+	}
+
+	log.WithFields(log.Fields{"total": total, "source": source, "failed": failed}).Info("blacklist database initialized")
+	return total, failed
+}
+
+// buildIPBlacklist downloads the ip blacklist sources into memory,
+// it returns the bucket and the number of sources which failed.
+func buildIPBlacklist(sources []string) (*adblockr.IPBucket, int) {
+	log.Info("initializing ip blacklist")
+
+	httpClient := adblockr.NewHttpClient(config.Nameservers[0], dnsTimeoutMs, httpTimeoutSecs)
+	bucket := adblockr.NewIPBucket()
+	failed := 0
+	for _, uri := range sources {
+		func() {
+			list, err := openSource(uri, httpClient)
+			if err != nil {
+				failed++
+				log.WithField("uri", uri).WithError(err).Errorf("download failed")
+				return
+			}
+			defer list.Close()
+
+			count, err := adblockr.LoadIPRules(list, uri, bucket)
+			if err != nil {
+				failed++
+				log.WithField("uri", uri).WithError(err).Errorf("download failed")
+				return
+			}
+			log.WithField("uri", uri).WithField("count", count).Info("download success")
+		}()
+	}
+	log.WithFields(log.Fields{"total": bucket.Len(), "source": len(sources), "failed": failed}).Info("ip blacklist initialized")
+	return bucket, failed
+}
+
+// openSource opens a source through the source cache when configured.
+func openSource(uri string, httpClient *http.Client) (io.ReadCloser, error) {
+	if config.SourceCache == "" {
+		return adblockr.OpenResource(uri, httpClient)
+	}
+	cache, err := adblockr.NewResourceCache(config.SourceCache)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Open(uri, httpClient)
+}
+
+func openDbBuckets(filepath string) (*adblockr.DbDomainBucket, *adblockr.DbDomainBucket, error) {
+	blacklist := adblockr.NewDbDomainBucket().(*adblockr.DbDomainBucket)
+	if err := blacklist.Open(filepath); err != nil {
+		return nil, nil, err
+	}
+	exceptions, err := blacklist.Sub("exceptions")
+	if err != nil {
+		blacklist.Close()
+		return nil, nil, err
+	}
+	return blacklist, exceptions, nil
+}
+
+// openBlacklistStore opens an existing database file, or downloads all sources when
+// there is no database yet or the in-memory backend is used.
+func openBlacklistStore(filepath string) (*blacklistStore, error) {
+	if filepath == "" || !fileExists(filepath) {
+		return buildBlacklistStore(filepath, true)
+	}
+	blacklist, exceptions, err := openDbBuckets(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return &blacklistStore{blacklist: blacklist, exceptions: exceptions, cache: blacklist.CacheStore(), close: blacklist.Close}, nil
+}
+
+// buildBlacklistStore downloads all sources into a new store, a database is built next to
+// the database file and only moved into its place once complete.
+// Unless allowFailed is set, the store is discarded when any source failed.
+func buildBlacklistStore(filepath string, allowFailed bool) (*blacklistStore, error) {
+	if filepath == "" {
+		blacklist, exceptions := adblockr.NewMemDomainBucket(), adblockr.NewMemDomainBucket()
+		_, failed := initBlacklistFromSources(config.Blacklist, blacklist, exceptions)
+		if failed > 0 && !allowFailed {
+			return nil, fmt.Errorf("%d of %d sources failed", failed, len(config.Blacklist))
+		}
+		return &blacklistStore{blacklist: blacklist, exceptions: exceptions, close: func() error { return nil }}, nil
+	}
+
+	tmpFile := filepath + ".new"
+	_ = os.Remove(tmpFile)
+	blacklist, exceptions, err := openDbBuckets(tmpFile)
+	if err != nil {
+		return nil, err
+	}
+	_, failed := initBlacklistFromSources(config.Blacklist, blacklist, exceptions)
+	if failed > 0 && !allowFailed {
+		err = fmt.Errorf("%d of %d sources failed", failed, len(config.Blacklist))
+	} else {
+		err = os.Rename(tmpFile, filepath)
+	}
+	if err != nil {
+		blacklist.Close()
+		_ = os.Remove(tmpFile)
+		return nil, err
+	}
+	return &blacklistStore{blacklist: blacklist, exceptions: exceptions, cache: blacklist.CacheStore(), close: blacklist.Close}, nil
+}
+
+// buildClientGroups downloads the sources of every client group into memory,
+// it returns the groups and the number of sources which failed.
+func buildClientGroups(configs []ClientGroupConfig) ([]*adblockr.ClientGroup, int) {
+	var groups []*adblockr.ClientGroup
+	failed := 0
+	for _, c := range configs {
+		networks, _ := adblockr.ParseNetworks(c.Clients)
+		blockMode, _ := adblockr.ParseBlockMode(c.BlockMode)
+		group := &adblockr.ClientGroup{
+			Name:      c.Name,
+			Networks:  networks,
+			Whitelist: adblockr.NewMemDomainBucket(),
+			BlockMode: blockMode,
+		}
+		for _, rule := range whitelistRules(c.Whitelist) {
+			group.Whitelist.Put(rule)
+		}
+		if len(c.Blacklist) > 0 {
+			log.WithField("group", c.Name).Info("initializing client group blacklist")
+			group.Blacklist = adblockr.NewMemDomainBucket()
+			_, n := initBlacklistFromSources(c.Blacklist, group.Blacklist, group.Whitelist)
+			failed += n
+		}
+		groups = append(groups, group)
+	}
+	return groups, failed
+}
+
+// blacklistRefresher rebuilds the blacklist store and swaps it into the running server,
+// rules and whitelist entries added at runtime are kept.
+type blacklistRefresher struct {
+	mu        sync.Mutex
+	store     *blacklistStore
+	server    *adblockr.Server
+	blacklist adblockr.DomainBucket
+	whitelist adblockr.DomainBucket
+	quit      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newBlacklistRefresher(store *blacklistStore, server *adblockr.Server, blacklist adblockr.DomainBucket,
+	whitelist adblockr.DomainBucket) *blacklistRefresher {
+	return &blacklistRefresher{
+		store:     store,
+		server:    server,
+		blacklist: blacklist,
+		whitelist: whitelist,
+		quit:      make(chan struct{}),
+	}
+}
+
+func (r *blacklistRefresher) run(interval time.Duration) {
+	log.WithField("interval", interval).Info("blacklist refresh scheduled")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			if err := r.refresh(); err != nil {
+				log.WithError(err).Error("blacklist refresh failed")
+			}
+		}
+	}
+}
+
+func (r *blacklistRefresher) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	groups, failed := buildClientGroups(config.ClientGroups)
+	if failed > 0 {
+		return fmt.Errorf("keeping the current blacklist: %d client group sources failed", failed)
+	}
+	var ipBlacklist *adblockr.IPBucket
+	if len(config.IPBlacklist) > 0 {
+		ipBlacklist, failed = buildIPBlacklist(config.IPBlacklist)
+		if failed > 0 {
+			return fmt.Errorf("keeping the current blacklist: %d ip blacklist sources failed", failed)
+		}
+	}
+	store, err := buildBlacklistStore(config.DbFile, false)
+	if err != nil {
+		return fmt.Errorf("keeping the current blacklist: %v", err)
+	}
+	r.server.SetClientGroups(groups)
+	r.server.SetIPBlacklist(ipBlacklist)
+
+	r.server.SetBuckets(adblockr.NewMultiDomainBucket(r.blacklist, store.blacklist),
+		adblockr.NewMultiDomainBucket(r.whitelist, store.exceptions))
+	if err := r.store.close(); err != nil {
+		log.WithError(err).Warn("unable to close previous blacklist")
+	}
+	r.store = store
+	log.Info("blacklist refreshed")
+	return nil
+}
+
+// refreshIPBlacklist only rebuilds the ip blacklist, sources which failed are left out.
+func (r *blacklistRefresher) refreshIPBlacklist() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ipBlacklist *adblockr.IPBucket
+	if len(config.IPBlacklist) > 0 {
+		ipBlacklist, _ = buildIPBlacklist(config.IPBlacklist)
+	}
+	r.server.SetIPBlacklist(ipBlacklist)
+	log.Info("ip blacklist reloaded")
+}
+
+// refreshGroups only rebuilds the client groups, sources which failed are left out.
+func (r *blacklistRefresher) refreshGroups() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	groups, _ := buildClientGroups(config.ClientGroups)
+	r.server.SetClientGroups(groups)
+	log.WithField("count", len(groups)).Info("client groups reloaded")
+}
+
+// LoadCache reads the answer cache from the current database, which is replaced on every refresh.
+func (r *blacklistRefresher) LoadCache() ([]adblockr.CacheItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store.cache == nil {
+		return nil, fmt.Errorf("the answer cache requires a db_file")
+	}
+	return r.store.cache.LoadCache()
+}
+
+// SaveCache writes the answer cache to the current database.
+func (r *blacklistRefresher) SaveCache(items []adblockr.CacheItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store.cache == nil {
+		return fmt.Errorf("the answer cache requires a db_file")
+	}
+	return r.store.cache.SaveCache(items)
+}
+
+func (r *blacklistRefresher) stop() {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+	})
+}
+
+func (r *blacklistRefresher) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store.close()
+}
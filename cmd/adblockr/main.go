@@ -1,24 +1,112 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/frengky/adblockr"
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 type ServerConfig struct {
-	ListenAddress string   `yaml:"listen_address"`
-	Nameservers   []string `yaml:"nameservers,flow"`
-	Blacklist     []string `yaml:"blacklist_sources,flow"`
-	Whitelist     []string `yaml:"whitelist_domains,flow"`
-	DbFile        string   `yaml:"db_file"`
+	ListenAddress string              `yaml:"listen_address"`
+	Nameservers   []string            `yaml:"nameservers,flow"`
+	Strategy      string              `yaml:"upstream_strategy"`
+	Weights       map[string]int      `yaml:"upstream_weights"`
+	Forwarding    []ForwardingConfig  `yaml:"conditional_forwarding"`
+	LocalRecords  []string            `yaml:"local_records"`
+	HostsFiles    []string            `yaml:"hosts_files,flow"`
+	Blacklist     []SourceConfig      `yaml:"blacklist_sources,flow"`
+	IPBlacklist   []string            `yaml:"ip_blacklist_sources,flow"`
+	Whitelist     []string            `yaml:"whitelist_domains,flow"`
+	DbFile        string              `yaml:"db_file"`
+	Admin         AdminConfig         `yaml:"admin"`
+	Metrics       string              `yaml:"metrics_address"`
+	QueryLog      QueryLogConfig      `yaml:"query_log"`
+	Refresh       time.Duration       `yaml:"refresh_interval"`
+	SourceCache   string              `yaml:"source_cache_dir"`
+	ClientGroups  []ClientGroupConfig `yaml:"client_groups"`
+	TLS           TLSConfig           `yaml:"tls"`
+	DoH           DoHConfig           `yaml:"doh"`
+	AnswerCache   AnswerCacheConfig   `yaml:"answer_cache"`
+}
+
+type AnswerCacheConfig struct {
+	File string `yaml:"file"`
+	InDb bool   `yaml:"in_db"`
+}
+
+// ForwardingConfig sends the queries of domains and their subdomains to other upstreams,
+// either nameservers (port 853 for DNS over TLS) or a DNS over HTTPS url.
+type ForwardingConfig struct {
+	Domains     []string `yaml:"domains,flow"`
+	Nameservers []string `yaml:"nameservers,flow"`
+	Doh         string   `yaml:"doh"`
+}
+
+type DoHConfig struct {
+	ListenAddress  string   `yaml:"listen_address"`
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type TLSConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	CertFile      string `yaml:"cert_file"`
+	KeyFile       string `yaml:"key_file"`
+}
+
+type ClientGroupConfig struct {
+	Name      string         `yaml:"name"`
+	Clients   []string       `yaml:"clients,flow"`
+	Blacklist []SourceConfig `yaml:"blacklist_sources,flow"`
+	Whitelist []string       `yaml:"whitelist_domains,flow"`
+	BlockMode string         `yaml:"block_mode"`
+}
+
+type QueryLogConfig struct {
+	File      string        `yaml:"file"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type AdminConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	Token         string `yaml:"token"`
+}
+
+// SourceConfig is either a plain uri or a mapping with uri and match mode.
+type SourceConfig struct {
+	Uri  string `yaml:"uri"`
+	Mode string `yaml:"mode"`
+}
+
+func (c *SourceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Uri); err == nil {
+		return nil
+	}
+	type plain SourceConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if _, err := adblockr.ParseMatchMode(c.Mode); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c SourceConfig) MatchMode() adblockr.MatchMode {
+	mode, _ := adblockr.ParseMatchMode(c.Mode)
+	return mode
 }
 
 var (
@@ -33,6 +121,24 @@ var (
 	dohUrl              string
 	cacheExpireSecs     = 3600
 	cleanUpIntervalSecs = 300
+	cacheSize           = 0
+	workers             = 64
+	queueSize           = 1024
+	refuseOnOverload    = false
+	rejectReason        = false
+	cnameCheck          = true
+	svcbCheck           = false
+	servFailTTLSecs     = 5
+	prefetch            = 0.0
+	prefetchHits        = 2
+	serveStaleSecs      = 0
+	queryLogFile        string
+	queryLogClient      string
+	queryLogDomain      string
+	queryLogSince       string
+	queryLogUntil       string
+	queryLogLimit       = 100
+	queryLogJson        = false
 
 	rootCmd = &cobra.Command{
 		Use:   "adblockr",
@@ -58,6 +164,15 @@ var (
 		},
 	}
 
+	queryLogCmd = &cobra.Command{
+		Use:   "querylog",
+		Short: "Show recorded DNS queries",
+		Long:  "Show recorded DNS queries from the query log file, filtered by client, domain and time range",
+		Run: func(cmd *cobra.Command, args []string) {
+			runQueryLog()
+		},
+	}
+
 	parseCmd = &cobra.Command{
 		Use:   "parse",
 		Short: "Parse a compatible host file format to domain list",
@@ -73,6 +188,16 @@ func init() {
 
 	serveCmd.Flags().IntVarP(&resolverIntervalMs, "nameserver-interval", "n", resolverIntervalMs, "Nameserver switch interval in ms")
 	serveCmd.Flags().StringVar(&dohUrl, "doh", dohUrl, "Enable DNS over HTTPS, example: \"https://dns.google/dns-query\"")
+	serveCmd.Flags().IntVarP(&workers, "workers", "w", workers, "Number of concurrent query workers")
+	serveCmd.Flags().IntVarP(&queueSize, "queue-size", "q", queueSize, "Maximum number of queries waiting for a worker")
+	serveCmd.Flags().BoolVar(&rejectReason, "reject-reason", rejectReason, "Explain the blocking rule and its source in a TXT record of rejected answers")
+	serveCmd.Flags().IntVar(&servFailTTLSecs, "servfail-cache", servFailTTLSecs, "Cache failed lookups for this many seconds, 0 to disable")
+	serveCmd.Flags().Float64Var(&prefetch, "prefetch", prefetch, "Refresh popular cache entries when this fraction of their TTL remains, 0 to disable")
+	serveCmd.Flags().IntVar(&prefetchHits, "prefetch-hits", prefetchHits, "Number of cache hits before an entry is prefetched")
+	serveCmd.Flags().IntVar(&serveStaleSecs, "serve-stale", serveStaleSecs, "Keep expired cache entries this many seconds to answer when upstreams fail, 0 to disable")
+	serveCmd.Flags().BoolVar(&cnameCheck, "cname-check", cnameCheck, "Block answers whose CNAME chain points to a blacklisted domain")
+	serveCmd.Flags().BoolVar(&svcbCheck, "svcb-check", svcbCheck, "Block answers whose SVCB or HTTPS records point to a blacklisted domain")
+	serveCmd.Flags().BoolVar(&refuseOnOverload, "refuse-on-overload", refuseOnOverload, "Reply REFUSED instead of SERVFAIL when the query queue is full")
 
 	initDbCmd.Flags().StringVarP(&dbFlag, "file", "f", dbFlag, "Path to database file")
 
@@ -80,13 +205,22 @@ func init() {
 		"Blacklist source URI, \"file///path/to.txt\" or \"http://some.where/blacklist.txt\"")
 	parseCmd.MarkFlagRequired("source")
 
+	queryLogCmd.Flags().StringVarP(&queryLogFile, "file", "f", queryLogFile, "Path to query log file, defaults to query_log file of the configuration")
+	queryLogCmd.Flags().StringVar(&queryLogClient, "client", queryLogClient, "Only show queries of this client ip")
+	queryLogCmd.Flags().StringVar(&queryLogDomain, "domain", queryLogDomain, "Only show queries of this domain and its subdomains")
+	queryLogCmd.Flags().StringVar(&queryLogSince, "since", queryLogSince, "Only show queries since a RFC3339 time or a duration ago, example: \"1h\"")
+	queryLogCmd.Flags().StringVar(&queryLogUntil, "until", queryLogUntil, "Only show queries until a RFC3339 time or a duration ago")
+	queryLogCmd.Flags().IntVarP(&queryLogLimit, "limit", "l", queryLogLimit, "Maximum number of latest queries to show, 0 for all")
+	queryLogCmd.Flags().BoolVar(&queryLogJson, "json", queryLogJson, "Print queries as JSON lines")
+
 	rootCmd.PersistentFlags().StringVarP(&configFlag, "config", "c", configFlag, "Path to configuration file")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", verbose, "Verbose output")
 	rootCmd.PersistentFlags().IntVar(&httpTimeoutSecs, "http-timeout", httpTimeoutSecs, "HTTP request timeout in sec")
 	rootCmd.PersistentFlags().IntVarP(&dnsTimeoutMs, "dns-timeout", "t", dnsTimeoutMs, "DNS resolver timeout in ms")
 	rootCmd.PersistentFlags().IntVarP(&cacheExpireSecs, "cache-expire", "x", cacheExpireSecs, "DNS cache duration in sec")
+	rootCmd.PersistentFlags().IntVar(&cacheSize, "cache-size", cacheSize, "Maximum number of cached answers, least recently used ones are evicted, 0 for no limit")
 	rootCmd.PersistentFlags().IntVarP(&cleanUpIntervalSecs, "cleanup-interval", "i", cleanUpIntervalSecs, "DNS cache cleanup interval in sec")
-	rootCmd.AddCommand(serveCmd, initDbCmd, parseCmd)
+	rootCmd.AddCommand(serveCmd, initDbCmd, parseCmd, queryLogCmd)
 }
 
 func onInit() {
@@ -99,24 +233,53 @@ func onInit() {
 
 	logCtx := log.WithField("config", configFlag)
 
-	f, err := os.Open(configFlag)
+	c, err := loadConfig(configFlag)
 	if err != nil {
-		logCtx.WithError(err).Error("unable to open configuration file")
+		logCtx.WithError(err).Error("unable to load configuration file")
 		os.Exit(1)
 	}
+	config = c
+}
+
+func loadConfig(filepath string) (*ServerConfig, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
+	c := &ServerConfig{}
 	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(config)
-	if err != nil {
-		logCtx.WithError(err).Error("invalid configuration file format")
-		os.Exit(1)
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("invalid configuration file format: %v", err)
 	}
 
-	if len(config.Nameservers) < 1 {
-		logCtx.Error("no nameservers found on configuration file")
-		os.Exit(1)
+	if len(c.Nameservers) < 1 {
+		return nil, fmt.Errorf("no nameservers found on configuration file")
+	}
+	if _, err := adblockr.ParseStrategy(c.Strategy); err != nil {
+		return nil, err
+	}
+	for _, rule := range c.Forwarding {
+		if len(rule.Domains) < 1 || (len(rule.Nameservers) < 1 && rule.Doh == "") {
+			return nil, fmt.Errorf("conditional forwarding requires domains and nameservers or doh")
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, group := range c.ClientGroups {
+		if group.Name == "" || names[group.Name] {
+			return nil, fmt.Errorf("client groups require an unique name")
+		}
+		names[group.Name] = true
+		if _, err := adblockr.ParseNetworks(group.Clients); err != nil {
+			return nil, fmt.Errorf("client group %s: %v", group.Name, err)
+		}
+		if _, err := adblockr.ParseBlockMode(group.BlockMode); err != nil {
+			return nil, fmt.Errorf("client group %s: %v", group.Name, err)
+		}
 	}
+	return c, nil
 }
 
 func main() {
@@ -125,36 +288,6 @@ func main() {
 	}
 }
 
-func initBlacklistFromSources(sourceUri []string, store adblockr.DomainBucket) {
-	log.Info("initializing blacklist database, may take a while...")
-
-	httpClient := adblockr.NewHttpClient(config.Nameservers[0], dnsTimeoutMs, httpTimeoutSecs)
-	total := 0
-	source := 0
-
-	for _, uri := range sourceUri {
-		source++
-		log.WithField("uri", uri).Info("processing sources")
-		func() {
-			list, err := adblockr.OpenResource(uri, httpClient)
-			if err != nil {
-				return
-			}
-			defer list.Close()
-
-			count, err := store.Update(list)
-			if err != nil {
-				log.WithField("uri", uri).WithError(err).Errorf("download failed")
-				return
-			}
-			log.WithField("uri", uri).WithField("count", count).Info("download success")
-			total = total + count
-		}()
-	}
-
-	log.WithFields(log.Fields{"total": total, "source": source}).Info("blacklist database initialized")
-}
-
 func runInitDb() {
 	logCtx := log.WithField("file", dbFlag)
 	if fileExists(dbFlag) {
@@ -162,61 +295,98 @@ func runInitDb() {
 		os.Exit(1)
 	}
 
-	blacklist := adblockr.NewDbDomainBucket().(*adblockr.DbDomainBucket)
-	if err := blacklist.Open(dbFlag); err != nil {
+	blacklist, exceptions, err := openDbBuckets(dbFlag)
+	if err != nil {
 		logCtx.WithError(err).Error("error opening database")
 		os.Exit(1)
 	}
 	defer blacklist.Close()
-	initBlacklistFromSources(config.Blacklist, blacklist)
+	initBlacklistFromSources(config.Blacklist, blacklist, exceptions)
 }
 
 func runServe() {
-	var (
-		blacklist adblockr.DomainBucket
-		whitelist = adblockr.NewMemDomainBucket()
-		init      = false
-	)
+	whitelist := adblockr.NewMemDomainBucket()
+	for _, rule := range whitelistRules(config.Whitelist) {
+		whitelist.Put(rule)
+	}
 
 	if config.DbFile == "" {
 		log.Info("starting DNS proxy with ad filter (using in-memory backend)")
-		init = true
-		blacklist = adblockr.NewMemDomainBucket()
 	} else {
 		log.WithField("file", config.DbFile).Info("starting DNS proxy with ad filter (using db backend)")
-		init = !fileExists(config.DbFile)
-		blacklist = adblockr.NewDbDomainBucket()
-		if err := blacklist.(*adblockr.DbDomainBucket).Open(config.DbFile); err != nil {
-			log.WithField("file", config.DbFile).WithError(err).Error("unable to open database")
-			os.Exit(1)
-		}
-		defer blacklist.(*adblockr.DbDomainBucket).Close()
-	}
-	if init {
-		initBlacklistFromSources(config.Blacklist, blacklist)
 	}
-
-	for _, entry := range config.Whitelist {
-		whitelist.Put(entry, true)
+	store, err := openBlacklistStore(config.DbFile)
+	if err != nil {
+		log.WithField("file", config.DbFile).WithError(err).Error("unable to open database")
+		os.Exit(1)
 	}
+	blacklistRules := adblockr.NewMemDomainBucket()
+	blacklist := adblockr.NewMultiDomainBucket(blacklistRules, store.blacklist)
 
 	var wg sync.WaitGroup
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 
-	var resolver adblockr.Resolver
-
-	if dohUrl != "" {
-		httpClient := adblockr.NewHttpClient(config.Nameservers[0], dnsTimeoutMs, 1000)
-		resolver = adblockr.NewDohResolver(dohUrl, httpClient)
-	} else {
-		resolver = adblockr.NewResolver(config.Nameservers, resolverIntervalMs, dnsTimeoutMs)
-	}
+	resolver := newResolver(config)
 
 	cacheExpire := time.Duration(cacheExpireSecs) * time.Second
 	cleanUpInterval := time.Duration(cleanUpIntervalSecs) * time.Second
-	server := adblockr.NewServer(config.ListenAddress, resolver, blacklist, whitelist, cacheExpire, cleanUpInterval)
+	if refuseOnOverload {
+		adblockr.OverloadRcode = dns.RcodeRefused
+	}
+	adblockr.RejectWithReason = rejectReason
+	adblockr.CheckCNAMEs = cnameCheck
+	adblockr.CheckSVCBTargets = svcbCheck
+	if servFailTTLSecs >= 0 {
+		adblockr.ServFailTTL = uint32(servFailTTLSecs)
+	}
+	server := adblockr.NewServer(config.ListenAddress, resolver, blacklist,
+		adblockr.NewMultiDomainBucket(whitelist, store.exceptions), cacheExpire, cleanUpInterval, workers, queueSize)
+
+	if cacheSize > 0 {
+		server.SetCache(adblockr.NewLRUCache(cacheSize))
+	}
+	server.SetPrefetch(prefetch, prefetchHits)
+	server.SetServeStale(time.Duration(serveStaleSecs) * time.Second)
+
+	if config.TLS.ListenAddress != "" {
+		if err := server.SetTLS(config.TLS.ListenAddress, config.TLS.CertFile, config.TLS.KeyFile); err != nil {
+			log.WithError(err).Error("unable to load tls certificate")
+			os.Exit(1)
+		}
+	}
+
+	refresher := newBlacklistRefresher(store, server, blacklistRules, whitelist)
+	groups, _ := buildClientGroups(config.ClientGroups)
+	server.SetClientGroups(groups)
+	server.SetLocalRecords(newLocalRecords(config))
+	if len(config.IPBlacklist) > 0 {
+		ipBlacklist, _ := buildIPBlacklist(config.IPBlacklist)
+		server.SetIPBlacklist(ipBlacklist)
+	}
+	if config.AnswerCache.InDb {
+		server.SetCacheStore(refresher)
+	} else if config.AnswerCache.File != "" {
+		server.SetCacheStore(adblockr.NewFileCacheStore(config.AnswerCache.File))
+	}
+	if config.Refresh > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refresher.run(config.Refresh)
+		}()
+	}
+
+	var queryLog *adblockr.QueryLog
+	if config.QueryLog.File != "" {
+		log.WithFields(log.Fields{
+			"file":      config.QueryLog.File,
+			"retention": config.QueryLog.Retention,
+		}).Info("query log enabled")
+		queryLog = adblockr.NewQueryLog(config.QueryLog.File, config.QueryLog.Retention)
+		server.SetQueryLog(queryLog)
+	}
 
 	wg.Add(1)
 	go func() {
@@ -224,9 +394,77 @@ func runServe() {
 		server.ListenAndServe()
 	}()
 
+	var admin *adblockr.AdminServer
+	if config.Admin.ListenAddress != "" {
+		if config.Admin.Token == "" {
+			log.Error("admin api requires a token, admin api disabled")
+		} else {
+			admin = adblockr.NewAdminServer(config.Admin.ListenAddress, config.Admin.Token, server, refresher.refresh)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				admin.ListenAndServe()
+			}()
+		}
+	}
+
+	var dohServer *adblockr.DoHServer
+	if config.DoH.ListenAddress != "" {
+		proxies, err := adblockr.ParseNetworks(config.DoH.TrustedProxies)
+		if err != nil {
+			log.WithError(err).Error("invalid doh trusted_proxies")
+			os.Exit(1)
+		}
+		dohServer = adblockr.NewDoHServer(config.DoH.ListenAddress, config.DoH.CertFile, config.DoH.KeyFile, proxies, server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dohServer.ListenAndServe()
+		}()
+	}
+
+	var metricsServer *http.Server
+	if config.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", adblockr.NewMetricsHandler(server))
+		metricsServer = &http.Server{Addr: config.Metrics, Handler: mux}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.WithField("listen", config.Metrics).Info("metrics ready for connection")
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("metrics server error")
+			}
+		}()
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	reloader := &configReloader{server: server, refresher: refresher, whitelist: whitelist}
+	go func() {
+		for range hupChan {
+			reloader.reload()
+		}
+	}()
+
 	<-sigChan
+	signal.Stop(hupChan)
+	if admin != nil {
+		admin.Shutdown()
+	}
+	if dohServer != nil {
+		dohServer.Shutdown()
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	refresher.stop()
 	server.Shutdown()
 	wg.Wait()
+	if queryLog != nil {
+		queryLog.Close()
+	}
+	refresher.close()
 	os.Exit(0)
 }
 
@@ -239,7 +477,7 @@ func runParse() {
 	logCtx := log.WithField("uri", parseSourceFlag)
 
 	httpClient := adblockr.NewHttpClient(config.Nameservers[0], dnsTimeoutMs, httpTimeoutSecs)
-	r, err := adblockr.OpenResource(parseSourceFlag, httpClient)
+	r, err := openSource(parseSourceFlag, httpClient)
 	if err != nil {
 		logCtx.WithError(err).Error("unable to open uri")
 		os.Exit(1)
@@ -247,8 +485,8 @@ func runParse() {
 	defer r.Close()
 
 	fmt.Fprintln(os.Stdout, fmt.Sprintf("# %s", parseSourceFlag))
-	count, err := adblockr.ParseLine(r, func(line string) bool {
-		fmt.Fprintln(os.Stdout, line)
+	count, err := adblockr.ParseLine(r, func(rule adblockr.Rule) bool {
+		fmt.Fprintln(os.Stdout, rule)
 		return true
 	})
 	fmt.Fprintln(os.Stdout, fmt.Sprintf("# Total %d", count))
@@ -261,6 +499,74 @@ func runParse() {
 	os.Exit(0)
 }
 
+func runQueryLog() {
+	file := queryLogFile
+	if file == "" {
+		file = config.QueryLog.File
+	}
+	if file == "" {
+		log.Error("no query log file specified")
+		os.Exit(1)
+	}
+	logCtx := log.WithField("file", file)
+
+	filter := adblockr.QueryLogFilter{
+		ClientIP: queryLogClient,
+		Domain:   queryLogDomain,
+		Limit:    queryLogLimit,
+	}
+	var err error
+	if filter.Since, err = parseTimeFlag(queryLogSince); err != nil {
+		log.WithError(err).Error("invalid --since value")
+		os.Exit(1)
+	}
+	if filter.Until, err = parseTimeFlag(queryLogUntil); err != nil {
+		log.WithError(err).Error("invalid --until value")
+		os.Exit(1)
+	}
+
+	entries, err := adblockr.ReadQueryLog(file, filter)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to read query log")
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		if queryLogJson {
+			encoder.Encode(e)
+			continue
+		}
+		result := strings.Join(e.Answer, ", ")
+		if e.Rule != "" {
+			result = "blocked by " + e.Rule
+		}
+		if e.CNAME != "" {
+			result += " via cname " + e.CNAME
+		}
+		if e.IP != "" {
+			result += " via ip " + e.IP
+		}
+		origin := e.Upstream
+		if e.Cached {
+			origin = "cache"
+		}
+		fmt.Fprintf(os.Stdout, "%s %-15s %-5s %s %s %s [%s] %s %s\n", e.Time.Local().Format(time.RFC3339),
+			e.ClientIP, e.Type, e.Name, e.Rcode, result, origin, e.Latency.Round(time.Microsecond), e.Network)
+	}
+	os.Exit(0)
+}
+
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func fileExists(filepath string) bool {
 	info, err := os.Stat(filepath)
 	if os.IsNotExist(err) {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/frengky/adblockr"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+)
+
+func newResolver(c *ServerConfig) adblockr.Resolver {
+	var resolver adblockr.Resolver
+	if dohUrl != "" {
+		httpClient := adblockr.NewHttpClient(c.Nameservers[0], dnsTimeoutMs, 1000)
+		resolver = adblockr.NewDohResolver(dohUrl, httpClient)
+	} else {
+		strategy, _ := adblockr.ParseStrategy(c.Strategy)
+		resolver = adblockr.NewStrategyResolver(c.Nameservers, strategy, c.Weights, resolverIntervalMs, dnsTimeoutMs)
+	}
+	if len(c.Forwarding) == 0 {
+		return resolver
+	}
+
+	routes := make(map[string]adblockr.Resolver)
+	for _, rule := range c.Forwarding {
+		var forward adblockr.Resolver
+		if rule.Doh != "" {
+			bootstrap := c.Nameservers[0]
+			if len(rule.Nameservers) > 0 {
+				bootstrap = rule.Nameservers[0]
+			}
+			forward = adblockr.NewDohResolver(rule.Doh, adblockr.NewHttpClient(bootstrap, dnsTimeoutMs, 1000))
+		} else {
+			forward = adblockr.NewResolver(rule.Nameservers, resolverIntervalMs, dnsTimeoutMs)
+		}
+		for _, domain := range rule.Domains {
+			routes[domain] = forward
+		}
+	}
+	return adblockr.NewConditionalResolver(routes, resolver)
+}
+
+// newLocalRecords reads the local records of the configuration and its hosts files,
+// invalid records and unreadable files are left out.
+func newLocalRecords(c *ServerConfig) *adblockr.LocalRecords {
+	records := adblockr.NewLocalRecords()
+	for _, record := range c.LocalRecords {
+		if err := records.AddRecord(record); err != nil {
+			log.WithField("record", record).WithError(err).Warn("invalid local record")
+		}
+	}
+	for _, file := range c.HostsFiles {
+		func() {
+			f, err := os.Open(file)
+			if err != nil {
+				log.WithField("file", file).WithError(err).Warn("unable to read hosts file")
+				return
+			}
+			defer f.Close()
+			if _, err := records.LoadHosts(f); err != nil {
+				log.WithField("file", file).WithError(err).Warn("unable to read hosts file")
+			}
+		}()
+	}
+	if records.Len() > 0 {
+		log.WithField("count", records.Len()).Info("local records loaded")
+	}
+	return records
+}
+
+func whitelistRules(entries []string) []adblockr.Rule {
+	var rules []adblockr.Rule
+	for _, entry := range entries {
+		rule, ok, err := adblockr.ParseRule(entry)
+		if err != nil || !ok {
+			log.WithField("entry", entry).WithError(err).Warn("invalid whitelist entry")
+			continue
+		}
+		rule.Exception = true
+		rule.Source = configFlag
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// configReloader applies a changed configuration file to the running server.
+type configReloader struct {
+	server    *adblockr.Server
+	refresher *blacklistRefresher
+	whitelist adblockr.DomainBucket
+}
+
+func (r *configReloader) reload() {
+	logCtx := log.WithField("config", configFlag)
+	logCtx.Info("reloading configuration")
+
+	newConfig, err := loadConfig(configFlag)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to reload configuration, keeping the current one")
+		return
+	}
+
+	r.refresher.mu.Lock()
+	oldConfig := *config
+	if newConfig.Refresh != oldConfig.Refresh || newConfig.DbFile != oldConfig.DbFile ||
+		newConfig.SourceCache != oldConfig.SourceCache || newConfig.Admin != oldConfig.Admin ||
+		newConfig.Metrics != oldConfig.Metrics || newConfig.QueryLog != oldConfig.QueryLog ||
+		newConfig.TLS != oldConfig.TLS || !reflect.DeepEqual(newConfig.DoH, oldConfig.DoH) ||
+		newConfig.AnswerCache != oldConfig.AnswerCache {
+		logCtx.Warn("changes of refresh_interval, db_file, source_cache_dir, admin, metrics_address, query_log, tls, doh and answer_cache only apply after a restart")
+		newConfig.Refresh, newConfig.DbFile, newConfig.SourceCache = oldConfig.Refresh, oldConfig.DbFile, oldConfig.SourceCache
+		newConfig.Admin, newConfig.Metrics, newConfig.QueryLog = oldConfig.Admin, oldConfig.Metrics, oldConfig.QueryLog
+		newConfig.TLS, newConfig.DoH, newConfig.AnswerCache = oldConfig.TLS, oldConfig.DoH, oldConfig.AnswerCache
+	}
+	*config = *newConfig
+	r.refresher.mu.Unlock()
+
+	if !reflect.DeepEqual(oldConfig.Whitelist, newConfig.Whitelist) {
+		keep := make(map[string]bool)
+		for _, rule := range whitelistRules(newConfig.Whitelist) {
+			keep[rule.Key] = true
+			r.whitelist.Put(rule)
+		}
+		for _, rule := range whitelistRules(oldConfig.Whitelist) {
+			if !keep[rule.Key] {
+				r.whitelist.Forget(rule.Key)
+			}
+		}
+		r.server.FlushCache()
+		logCtx.WithField("count", len(keep)).Info("whitelist reloaded")
+	}
+
+	if !reflect.DeepEqual(oldConfig.Nameservers, newConfig.Nameservers) || oldConfig.Strategy != newConfig.Strategy ||
+		!reflect.DeepEqual(oldConfig.Weights, newConfig.Weights) || !reflect.DeepEqual(oldConfig.Forwarding, newConfig.Forwarding) {
+		r.server.SetResolver(newResolver(newConfig))
+		logCtx.WithFields(log.Fields{
+			"nameservers": newConfig.Nameservers,
+			"strategy":    newConfig.Strategy,
+		}).Info("nameservers reloaded")
+	}
+
+	// hosts files may have changed without a change of the configuration
+	r.server.SetLocalRecords(newLocalRecords(newConfig))
+
+	if oldConfig.ListenAddress != newConfig.ListenAddress {
+		if err := r.server.SetAddress(newConfig.ListenAddress); err != nil {
+			logCtx.WithError(err).Error("unable to change listen address, keeping the current one")
+		}
+	}
+
+	if !reflect.DeepEqual(oldConfig.Blacklist, newConfig.Blacklist) {
+		go func() {
+			if err := r.refresher.refresh(); err != nil {
+				logCtx.WithError(err).Error("blacklist reload failed")
+			}
+		}()
+	} else {
+		if !reflect.DeepEqual(oldConfig.ClientGroups, newConfig.ClientGroups) {
+			go r.refresher.refreshGroups()
+		}
+		if !reflect.DeepEqual(oldConfig.IPBlacklist, newConfig.IPBlacklist) {
+			go r.refresher.refreshIPBlacklist()
+		}
+	}
+}
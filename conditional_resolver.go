@@ -0,0 +1,79 @@
+package adblockr
+
+import (
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+)
+
+type conditionalResolver struct {
+	routes   map[string]Resolver
+	fallback Resolver
+}
+
+// NewConditionalResolver forwards queries for a domain and its subdomains to the resolver of the longest
+// matching domain in routes, other queries go to fallback. Domains may be written as "lan", ".lan" or "*.lan".
+func NewConditionalResolver(routes map[string]Resolver, fallback Resolver) Resolver {
+	r := &conditionalResolver{
+		routes:   make(map[string]Resolver, len(routes)),
+		fallback: fallback,
+	}
+	for domain, resolver := range routes {
+		domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), suffixPrefix)
+		r.routes[strings.ToLower(unFqdn(domain))] = resolver
+	}
+	return r
+}
+
+func (r *conditionalResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, string, error) {
+	return r.route(req.Question[0].Name).Lookup(net, req)
+}
+
+func (r *conditionalResolver) route(name string) Resolver {
+	domain := strings.ToLower(unFqdn(name))
+	for {
+		if resolver, ok := r.routes[domain]; ok {
+			log.WithFields(log.Fields{"qname": name, "route": domain}).Debug("forwarding conditionally")
+			return resolver
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return r.fallback
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Health returns the state of the upstreams of every resolver which tracks them.
+func (r *conditionalResolver) Health() []UpstreamStatus {
+	var status []UpstreamStatus
+	for _, resolver := range append([]Resolver{r.fallback}, r.resolvers()...) {
+		if reporter, ok := resolver.(HealthReporter); ok {
+			status = append(status, reporter.Health()...)
+		}
+	}
+	return status
+}
+
+// Close closes every resolver which can be closed.
+func (r *conditionalResolver) Close() error {
+	for _, resolver := range append([]Resolver{r.fallback}, r.resolvers()...) {
+		if closer, ok := resolver.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+func (r *conditionalResolver) resolvers() []Resolver {
+	seen := make(map[Resolver]bool)
+	var resolvers []Resolver
+	for _, resolver := range r.routes {
+		if !seen[resolver] {
+			seen[resolver] = true
+			resolvers = append(resolvers, resolver)
+		}
+	}
+	return resolvers
+}
@@ -0,0 +1,51 @@
+package adblockr
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+// namedResolver answers every question with its name as the upstream.
+type namedResolver string
+
+func (r namedResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, string, error) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	return m, string(r), nil
+}
+
+func TestConditionalResolverRoute(t *testing.T) {
+	r := NewConditionalResolver(map[string]Resolver{
+		"lan":               namedResolver("lan"),
+		"*.corp.example":    namedResolver("corp"),
+		".vpn.corp.example": namedResolver("vpn"),
+		"Home.Arpa.":        namedResolver("home"),
+	}, namedResolver("fallback"))
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"lan.", "lan"},
+		{"nas.lan.", "lan"},
+		{"NAS.LAN.", "lan"},
+		{"printer.office.lan.", "lan"},
+		{"plan.", "fallback"},
+		{"corp.example.", "corp"},
+		{"git.corp.example.", "corp"},
+		{"vpn.corp.example.", "vpn"},
+		{"gw.vpn.corp.example.", "vpn"},
+		{"router.home.arpa.", "home"},
+		{"example.", "fallback"},
+		{"example.com.", "fallback"},
+		{".", "fallback"},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		_, ns, err := r.Lookup("udp", req)
+		if err != nil || ns != tt.want {
+			t.Errorf("Lookup(%q) = %q, %v, want %q", tt.name, ns, err, tt.want)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package adblockr
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/gobwas/glob"
+	"github.com/boltdb/bolt"
 	"github.com/joyrexus/buckets"
-	"io"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -13,19 +12,25 @@ import (
 const (
 	domainBucket  = "domains"
 	patternBucket = "patterns"
+	suffixBucket  = "suffixes"
+
+	defaultValue = "true"
 )
 
 type DbDomainBucket struct {
 	db       *buckets.DB
+	prefix   string
+	shared   bool
 	dBucket  *buckets.Bucket
 	pBucket  *buckets.Bucket
-	patterns map[string]glob.Glob
+	sBucket  *buckets.Bucket
+	patterns map[string]patternRule
 	mu       sync.RWMutex
 }
 
 func NewDbDomainBucket() DomainBucket {
 	return &DbDomainBucket{
-		patterns: make(map[string]glob.Glob),
+		patterns: make(map[string]patternRule),
 		mu:       sync.RWMutex{},
 	}
 }
@@ -36,19 +41,43 @@ func (s *DbDomainBucket) Open(filepath string) error {
 	if err != nil {
 		return err
 	}
-	s.dBucket, err = s.db.New([]byte(domainBucket))
+	return s.init()
+}
+
+// Sub returns a separate bucket stored in the same database file, it is closed together with its parent.
+func (s *DbDomainBucket) Sub(name string) (*DbDomainBucket, error) {
+	sub := &DbDomainBucket{
+		db:       s.db,
+		prefix:   s.prefix + name + ".",
+		shared:   true,
+		patterns: make(map[string]patternRule),
+		mu:       sync.RWMutex{},
+	}
+	if err := sub.init(); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *DbDomainBucket) init() error {
+	var err error
+	s.dBucket, err = s.db.New([]byte(s.prefix + domainBucket))
+	if err != nil {
+		return err
+	}
+	s.pBucket, err = s.db.New([]byte(s.prefix + patternBucket))
 	if err != nil {
 		return err
 	}
-	s.pBucket, err = s.db.New([]byte(patternBucket))
+	s.sBucket, err = s.db.New([]byte(s.prefix + suffixBucket))
 	if err != nil {
 		return err
 	}
 	if items, err := s.pBucket.Items(); err == nil {
 		for _, p := range items {
 			key := string(p.Key)
-			if g, err := glob.Compile(key); err == nil {
-				s.patterns[key] = g
+			if g, err := compilePattern(key); err == nil {
+				s.patterns[key] = patternRule{glob: g, rule: decodeRule(key, p.Value)}
 			}
 		}
 	}
@@ -56,42 +85,73 @@ func (s *DbDomainBucket) Open(filepath string) error {
 }
 
 func (s *DbDomainBucket) Close() error {
+	if s.shared {
+		return nil
+	}
 	return s.db.Close()
 }
 
-func (s *DbDomainBucket) Put(key string, value bool) error {
-	if strings.ContainsAny(key, globChars) {
-		g, err := glob.Compile(key)
+func (s *DbDomainBucket) Put(rule Rule) error {
+	key := rule.Key
+	if isSuffixKey(key) {
+		return s.sBucket.Put([]byte(strings.ToLower(key[1:])), encodeRule(rule))
+	}
+	if isPatternKey(key) {
+		g, err := compilePattern(key)
 		if err == nil {
 			s.mu.Lock()
-			s.patterns[key] = g
+			s.patterns[key] = patternRule{glob: g, rule: rule}
 			s.mu.Unlock()
-			return s.pBucket.Put([]byte(key), []byte(strconv.FormatBool(value)))
+			return s.pBucket.Put([]byte(key), encodeRule(rule))
 		}
 		return fmt.Errorf("invalid patterns entry: `%s` %v", key, err)
 	}
-	return s.dBucket.Put([]byte(strings.ToLower(key)), []byte(strconv.FormatBool(value)))
+	return s.dBucket.Put([]byte(strings.ToLower(key)), encodeRule(rule))
 }
 
 func (s *DbDomainBucket) Has(domain string) bool {
+	_, ok := s.Match(domain)
+	return ok
+}
+
+func (s *DbDomainBucket) Match(domain string) (Rule, bool) {
+	var found ruleMatch
 	domain = strings.ToLower(domain)
 	val, err := s.dBucket.Get([]byte(domain))
-	if err == nil && len(val) >= 4 {
-		return true
+	if err == nil && val != nil && found.add(decodeRule(domain, val)) {
+		return found.rule, true
+	}
+
+	var suffixes []string
+	for suffix := domain; ; {
+		suffixes = append(suffixes, suffix)
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		val, err := s.sBucket.Get([]byte(suffixes[i]))
+		if err == nil && val != nil && found.add(decodeRule(suffixPrefix+suffixes[i], val)) {
+			return found.rule, true
+		}
 	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	for _, g := range s.patterns {
-		if g.Match(domain) {
-			return true
+	for _, p := range s.patterns {
+		if p.glob.Match(domain) && found.add(p.rule) {
+			return found.rule, true
 		}
 	}
-	return false
+	return found.rule, found.ok
 }
 
 func (s *DbDomainBucket) Forget(key string) {
-	if strings.ContainsAny(key, globChars) {
+	if isSuffixKey(key) {
+		s.sBucket.Delete([]byte(strings.ToLower(key[1:])))
+	} else if isPatternKey(key) {
 		s.mu.Lock()
 		delete(s.patterns, key)
 		s.mu.Unlock()
@@ -101,45 +161,94 @@ func (s *DbDomainBucket) Forget(key string) {
 	}
 }
 
-func (s *DbDomainBucket) Update(list io.Reader) (int, error) {
-	defaultValue := []byte(strconv.FormatBool(true))
-	var domains, patterns []struct {
+func (s *DbDomainBucket) Update(rules []Rule) (int, error) {
+	var domains, patterns, suffixes []struct {
 		Key, Value []byte
 	}
 
-	count, err := ParseLine(list, func(line string) bool {
-		if strings.ContainsAny(line, globChars) {
-			g, err := glob.Compile(line)
-			if err == nil {
-				s.patterns[line] = g
-				patterns = append(patterns, struct {
-					Key, Value []byte
-				}{
-					[]byte(line), defaultValue,
-				})
-				return true
+	count := 0
+	for _, rule := range rules {
+		line := rule.Key
+		if isSuffixKey(line) {
+			suffixes = append(suffixes, struct {
+				Key, Value []byte
+			}{
+				[]byte(strings.ToLower(line[1:])), encodeRule(rule),
+			})
+		} else if isPatternKey(line) {
+			g, err := compilePattern(line)
+			if err != nil {
+				continue
 			}
+			s.mu.Lock()
+			s.patterns[line] = patternRule{glob: g, rule: rule}
+			s.mu.Unlock()
+			patterns = append(patterns, struct {
+				Key, Value []byte
+			}{
+				[]byte(line), encodeRule(rule),
+			})
 		} else {
 			domains = append(domains, struct {
 				Key, Value []byte
 			}{
-				[]byte(strings.ToLower(line)), defaultValue,
+				[]byte(strings.ToLower(line)), encodeRule(rule),
 			})
-			return true
 		}
-		return false
-	})
-
-	if err != nil {
-		return 0, err
+		count++
 	}
 
 	if len(domains) > 0 {
-		s.dBucket.Insert(domains)
+		if err := s.dBucket.Insert(domains); err != nil {
+			return 0, err
+		}
 	}
 	if len(patterns) > 0 {
-		s.pBucket.Insert(patterns)
+		if err := s.pBucket.Insert(patterns); err != nil {
+			return 0, err
+		}
+	}
+	if len(suffixes) > 0 {
+		if err := s.sBucket.Insert(suffixes); err != nil {
+			return 0, err
+		}
 	}
 
 	return count, nil
 }
+
+func (s *DbDomainBucket) Len() int {
+	n := 0
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		for _, b := range []*buckets.Bucket{s.dBucket, s.pBucket, s.sBucket} {
+			if bucket := tx.Bucket(b.Name); bucket != nil {
+				n += bucket.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+type storedRule struct {
+	Source    string `json:"s,omitempty"`
+	Exception bool   `json:"e,omitempty"`
+	Important bool   `json:"i,omitempty"`
+}
+
+func encodeRule(rule Rule) []byte {
+	data, err := json.Marshal(storedRule{Source: rule.Source, Exception: rule.Exception, Important: rule.Important})
+	if err != nil {
+		return []byte(defaultValue)
+	}
+	return data
+}
+
+// decodeRule also accepts the plain values written by older versions.
+func decodeRule(key string, value []byte) Rule {
+	var stored storedRule
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return Rule{Key: key}
+	}
+	return Rule{Key: key, Source: stored.Source, Exception: stored.Exception, Important: stored.Important}
+}
@@ -10,13 +10,14 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 const dnsContentType = "application/dns-message"
 
 func NewDohResolver(dohUrl string, client *http.Client) Resolver {
 	host := dohUrl
-	if url, err := url.Parse(dohUrl); err != nil {
+	if url, err := url.Parse(dohUrl); err == nil {
 		host = url.Host
 	}
 	return &dohResolver{
@@ -32,7 +33,7 @@ type dohResolver struct {
 	client *http.Client
 }
 
-func (d *dohResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
+func (d *dohResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, string, error) {
 	logCtx := log.WithFields(log.Fields{
 		"upstream": d.host,
 		"qname":    req.Question[0].Name,
@@ -41,41 +42,48 @@ func (d *dohResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
 
 	data, err := req.Pack()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	reader := bytes.NewReader(data)
+	start := time.Now()
 	resp, err := d.client.Post(d.url, dnsContentType, reader)
 	if err != nil {
-		return nil, err
+		metricUpstreamErrors.inc(d.host)
+		return nil, "", err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		metricUpstreamErrors.inc(d.host)
 		io.Copy(ioutil.Discard, resp.Body)
 		logCtx.WithField("status", resp.StatusCode).Error("invalid response status code from upstream")
-		return nil, fmt.Errorf("error while resolving from upstream")
+		return nil, "", fmt.Errorf("error while resolving from upstream")
 	}
 
 	contentType := resp.Header.Get("Content-Type")
 	if !strings.Contains(contentType, dnsContentType) {
+		metricUpstreamErrors.inc(d.host)
 		io.Copy(ioutil.Discard, resp.Body)
 		logCtx.WithField("content-type", contentType).Error("invalid response format from upstream")
-		return nil, fmt.Errorf("error while resolving from upstream")
+		return nil, "", fmt.Errorf("error while resolving from upstream")
 	}
 
 	respPacket, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		metricUpstreamErrors.inc(d.host)
+		return nil, "", err
 	}
 
 	res := dns.Msg{}
 	err = res.Unpack(respPacket)
 	if err != nil {
-		return nil, err
+		metricUpstreamErrors.inc(d.host)
+		return nil, "", err
 	}
+	metricUpstreamDuration.observeSince(start, d.host)
 
 	logCtx.Debug("resolving with DoH")
-	return &res, nil
+	return &res, d.host, nil
 }
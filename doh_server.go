@@ -0,0 +1,215 @@
+package adblockr
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dohPath       = "/dns-query"
+	dohMaxMsgSize = dns.MaxMsgSize
+)
+
+// DoHServer serves DNS over HTTPS (RFC 8484) through the filtering path of a Server.
+type DoHServer struct {
+	address        string
+	certFile       string
+	keyFile        string
+	trustedProxies []*net.IPNet
+	server         *Server
+	httpServer     *http.Server
+}
+
+// NewDoHServer creates a DNS over HTTPS listener for a running server, plain HTTP is served
+// when no certificate is given, e.g. behind a reverse proxy listed in trustedProxies.
+func NewDoHServer(address string, certFile string, keyFile string, trustedProxies []*net.IPNet, server *Server) *DoHServer {
+	d := &DoHServer{
+		address:        address,
+		certFile:       certFile,
+		keyFile:        keyFile,
+		trustedProxies: trustedProxies,
+		server:         server,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, d.handleQuery)
+
+	d.httpServer = &http.Server{
+		Addr:         address,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return d
+}
+
+func (d *DoHServer) ListenAndServe() {
+	log.WithField("listen", d.address).Info("doh ready for connection")
+	var err error
+	if d.certFile != "" {
+		err = d.httpServer.ListenAndServeTLS(d.certFile, d.keyFile)
+	} else {
+		err = d.httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("doh server error")
+	}
+}
+
+func (d *DoHServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = d.httpServer.Shutdown(ctx)
+}
+
+func (d *DoHServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		if err == nil && len(buf) == 0 {
+			err = fmt.Errorf("missing dns parameter")
+		}
+	case http.MethodPost:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), dnsContentType) {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dohMaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	// the same checks as dns.DefaultMsgAcceptFunc of the other listeners
+	if req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		http.Error(w, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{
+		local:  localAddr(r),
+		remote: &net.TCPAddr{IP: d.clientIP(r)},
+	}
+	d.server.enqueue("https", rw, req)
+	if rw.msg == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rw.msg)))
+	_, _ = w.Write(out)
+}
+
+// clientIP returns the address of the connection, or the last untrusted address
+// of X-Forwarded-For when the connection comes from a trusted proxy.
+func (d *DoHServer) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !d.trusted(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !d.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (d *DoHServer) trusted(ip net.IP) bool {
+	for _, network := range d.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// dohResponseWriter captures the reply of the filtering path for an HTTP request.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m.Copy()
+	return nil
+}
+
+func (w *dohResponseWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(buf), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
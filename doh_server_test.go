@@ -0,0 +1,95 @@
+package adblockr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDoHServerClientIP(t *testing.T) {
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"127.0.0.1/32", "10.0.0.0/8"} {
+		network, _ := ParseIPNetwork(cidr)
+		proxies = append(proxies, network)
+	}
+	d := NewDoHServer("127.0.0.1:0", "", "", proxies, nil)
+
+	tests := []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"192.0.2.1:4000", nil, "192.0.2.1"},
+		{"192.0.2.1:4000", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"127.0.0.1:4000", nil, "127.0.0.1"},
+		{"127.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:4000", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:4000", []string{"198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		{"127.0.0.1:4000", []string{"198.51.100.1", "10.1.1.1"}, "198.51.100.1"},
+		{"127.0.0.1:4000", []string{"10.1.1.2, 10.1.1.1"}, "10.1.1.2"},
+		{"127.0.0.1:4000", []string{"unknown, 10.1.1.1"}, "10.1.1.1"},
+		{"[::1]:4000", []string{"198.51.100.1"}, "::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		r.RemoteAddr = tt.remote
+		for _, value := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := d.clientIP(r); got.String() != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestDoHServerInvalidQuery(t *testing.T) {
+	pack := func(m *dns.Msg) []byte {
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	empty := new(dns.Msg)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"put", http.MethodPut, dnsContentType, pack(query), http.StatusMethodNotAllowed},
+		{"content type", http.MethodPost, "text/plain", pack(query), http.StatusUnsupportedMediaType},
+		{"missing parameter", http.MethodGet, "", nil, http.StatusBadRequest},
+		{"garbage", http.MethodPost, dnsContentType, []byte{1, 2, 3}, http.StatusBadRequest},
+		{"response", http.MethodPost, dnsContentType, pack(response), http.StatusBadRequest},
+		{"notify", http.MethodGet, "", pack(notify), http.StatusBadRequest},
+		{"no question", http.MethodPost, dnsContentType, pack(empty), http.StatusBadRequest},
+	}
+	d := NewDoHServer("127.0.0.1:0", "", "", nil, nil)
+	for _, tt := range tests {
+		var r *http.Request
+		if tt.method == http.MethodGet {
+			r = httptest.NewRequest(tt.method, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(tt.body), nil)
+		} else {
+			r = httptest.NewRequest(tt.method, dohPath, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		d.handleQuery(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
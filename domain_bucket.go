@@ -3,21 +3,138 @@ package adblockr
 import (
 	"bufio"
 	"fmt"
+	"github.com/gobwas/glob"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 )
 
-const globChars = "*?[]"
+const (
+	globChars    = "*?[]"
+	suffixPrefix = "."
+)
+
+// MatchMode controls how plain domain entries of a source are matched,
+// MatchExact only matches the domain itself while MatchSuffix also matches all of its subdomains.
+type MatchMode int
+
+const (
+	MatchExact MatchMode = iota
+	MatchSuffix
+)
+
+func ParseMatchMode(mode string) (MatchMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "exact":
+		return MatchExact, nil
+	case "suffix":
+		return MatchSuffix, nil
+	default:
+		return MatchExact, fmt.Errorf("invalid match mode: %s", mode)
+	}
+}
+
+func (m MatchMode) String() string {
+	if m == MatchSuffix {
+		return "suffix"
+	}
+	return "exact"
+}
 
+// DomainBucket keys are either a domain (exact match), a glob pattern,
+// or a domain prefixed with a dot which matches the domain and all of its subdomains.
+// A domain wrapped in slashes is a regular expression.
 type DomainBucket interface {
-	Put(key string, value bool) error
+	Put(rule Rule) error
 	Has(domain string) bool
+	Match(domain string) (Rule, bool)
 	Forget(key string)
-	Update(list io.Reader) (int, error)
+	Update(rules []Rule) (int, error)
+	Len() int
+}
+
+// ruleMatch keeps the first matching rule unless an important one comes later,
+// add reports whether the search can stop.
+type ruleMatch struct {
+	rule Rule
+	ok   bool
+}
+
+func (m *ruleMatch) add(rule Rule) bool {
+	if !m.ok || rule.Important && !m.rule.Important {
+		m.rule, m.ok = rule, true
+	}
+	return m.rule.Important
+}
+
+type regexPattern struct {
+	*regexp.Regexp
+}
+
+func (r regexPattern) Match(s string) bool {
+	return r.MatchString(s)
+}
+
+func isPatternKey(key string) bool {
+	return isRegexKey(key) || strings.ContainsAny(key, globChars)
+}
+
+func compilePattern(key string) (glob.Glob, error) {
+	if isRegexKey(key) {
+		re, err := regexp.Compile(key[1 : len(key)-1])
+		if err != nil {
+			return nil, err
+		}
+		return regexPattern{re}, nil
+	}
+	return glob.Compile(key)
+}
+
+func isSuffixKey(key string) bool {
+	return strings.HasPrefix(key, suffixPrefix)
+}
+
+func bucketKey(line string, mode MatchMode) string {
+	if mode == MatchSuffix && !isSuffixKey(line) && !isPatternKey(line) {
+		return suffixPrefix + line
+	}
+	return line
+}
+
+// LoadRules parses a source list, blocking rules are stored to the blacklist and exceptions to the whitelist.
+func LoadRules(list io.Reader, source string, mode MatchMode, blacklist DomainBucket, whitelist DomainBucket) (int, error) {
+	var blocked, allowed []Rule
+	_, err := ParseLine(list, func(rule Rule) bool {
+		rule.Key = bucketKey(rule.Key, mode)
+		rule.Source = source
+		if rule.Exception {
+			allowed = append(allowed, rule)
+		} else {
+			blocked = append(blocked, rule)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := blacklist.Update(blocked)
+	if err != nil {
+		return count, err
+	}
+	if len(allowed) > 0 && whitelist != nil {
+		n, err := whitelist.Update(allowed)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
 }
 
 func OpenResource(uri string, httpClient *http.Client) (io.ReadCloser, error) {
@@ -55,25 +172,23 @@ func OpenResource(uri string, httpClient *http.Client) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
-func ParseLine(r io.Reader, handler func(line string) bool) (int, error) {
-	count := 0
+func ParseLine(r io.Reader, handler func(rule Rule) bool) (int, error) {
+	count, unsupported := 0, 0
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
-		line = strings.Split(line, "#")[0]
-		line = strings.TrimSpace(line)
-
-		if len(line) > 0 {
-			fields := strings.Fields(line)
-			if len(fields) > 1 {
-				line = fields[1]
-			} else {
-				line = fields[0]
-			}
-			if handler(line) {
-				count++
-			}
+		rule, ok, err := ParseRule(line)
+		if err != nil {
+			unsupported++
+			log.WithField("rule", line).WithError(err).Debug("skipping unsupported rule")
+			continue
 		}
+		if ok && handler(rule) {
+			count++
+		}
+	}
+	if unsupported > 0 {
+		log.WithField("count", unsupported).Warn("unsupported rules skipped")
 	}
 
 	return count, scanner.Err()
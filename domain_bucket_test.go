@@ -0,0 +1,71 @@
+package adblockr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDomainBucketMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := NewDbDomainBucket().(*DbDomainBucket)
+	if err := db.Open(filepath.Join(dir, "bucket.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	list := `ads.example.com
+||tracker.net^
+||cdn.tracker.net^$important
+|metrics.example.org^
+/^ad[0-9]+\.example\.net$/$important
+||example.net^
+banner*.example.com
+`
+	buckets := map[string]DomainBucket{"memory": NewMemDomainBucket(), "database": db}
+	for name, bucket := range buckets {
+		if _, err := LoadRules(strings.NewReader(list), "test", MatchExact, bucket, nil); err != nil {
+			t.Fatalf("%s: LoadRules() error = %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		domain string
+		key    string
+		ok     bool
+	}{
+		{"ads.example.com", "ads.example.com", true},
+		{"ADS.Example.com", "ads.example.com", true},
+		{"www.ads.example.com", "", false},
+		{"tracker.net", ".tracker.net", true},
+		{"img.tracker.net", ".tracker.net", true},
+		{"img.cdn.tracker.net", ".cdn.tracker.net", true},
+		{"metrics.example.org", "metrics.example.org", true},
+		{"www.example.net", ".example.net", true},
+		{"ad1.example.net", `/^ad[0-9]+\.example\.net$/`, true},
+		{"banner1.example.com", "banner*.example.com", true},
+		{"example.com", "", false},
+	}
+	for name, bucket := range buckets {
+		for _, tt := range tests {
+			rule, ok := bucket.Match(tt.domain)
+			if ok != tt.ok || rule.Key != tt.key {
+				t.Errorf("%s: Match(%q) = %q, %v, want %q, %v", name, tt.domain, rule.Key, ok, tt.key, tt.ok)
+			}
+			if ok && rule.Source != "test" {
+				t.Errorf("%s: Match(%q) source = %q, want test", name, tt.domain, rule.Source)
+			}
+		}
+
+		bucket.Forget(".cdn.tracker.net")
+		if rule, _ := bucket.Match("img.cdn.tracker.net"); rule.Key != ".tracker.net" {
+			t.Errorf("%s: Match(img.cdn.tracker.net) = %q after Forget, want .tracker.net", name, rule.Key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package adblockr
+
+import "strings"
+
+type domainNode struct {
+	children map[string]*domainNode
+	rule     *Rule
+}
+
+// domainTree stores domains by their reversed labels, a stored domain
+// matches itself and all of its subdomains.
+type domainTree struct {
+	root *domainNode
+	size int
+}
+
+func newDomainTree() *domainTree {
+	return &domainTree{root: &domainNode{}}
+}
+
+func (t *domainTree) insert(domain string, rule Rule) {
+	node := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*domainNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.rule == nil {
+		t.size++
+	}
+	node.rule = &rule
+}
+
+func (t *domainTree) remove(domain string) {
+	labels := strings.Split(domain, ".")
+	path := make([]*domainNode, 0, len(labels)+1)
+	node := t.root
+	path = append(path, node)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	if node.rule == nil {
+		return
+	}
+	node.rule = nil
+	t.size--
+
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].rule != nil || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, labels[len(labels)-i])
+	}
+}
+
+// match returns the rule of the shortest stored parent of the domain, including the domain itself,
+// an important rule of a longer parent takes precedence.
+func (t *domainTree) match(domain string) (Rule, bool) {
+	var found *Rule
+	node := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.rule != nil && (found == nil || node.rule.Important && !found.Important) {
+			found = node.rule
+			if found.Important {
+				break
+			}
+		}
+	}
+	if found == nil {
+		return Rule{}, false
+	}
+	return *found, true
+}
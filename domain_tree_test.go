@@ -0,0 +1,66 @@
+package adblockr
+
+import "testing"
+
+func TestDomainTreeMatch(t *testing.T) {
+	tree := newDomainTree()
+	tree.insert("example.com", Rule{Key: ".example.com"})
+	tree.insert("ads.example.com", Rule{Key: ".ads.example.com", Important: true})
+	tree.insert("tracker.net", Rule{Key: ".tracker.net"})
+	tree.insert("cdn.tracker.net", Rule{Key: ".cdn.tracker.net"})
+
+	tests := []struct {
+		domain string
+		key    string
+		ok     bool
+	}{
+		{"example.com", ".example.com", true},
+		{"www.example.com", ".example.com", true},
+		{"ads.example.com", ".ads.example.com", true},
+		{"x.ads.example.com", ".ads.example.com", true},
+		{"cdn.tracker.net", ".tracker.net", true},
+		{"img.cdn.tracker.net", ".tracker.net", true},
+		{"com", "", false},
+		{"badexample.com", "", false},
+		{"example.org", "", false},
+	}
+	for _, tt := range tests {
+		rule, ok := tree.match(tt.domain)
+		if ok != tt.ok || rule.Key != tt.key {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", tt.domain, rule.Key, ok, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestDomainTreeInsertRemove(t *testing.T) {
+	tree := newDomainTree()
+	tree.insert("example.com", Rule{Key: ".example.com"})
+	tree.insert("ads.example.com", Rule{Key: ".ads.example.com"})
+	tree.insert("example.com", Rule{Key: ".example.com", Source: "replaced"})
+	if tree.size != 2 {
+		t.Fatalf("size = %d, want 2", tree.size)
+	}
+	if rule, _ := tree.match("example.com"); rule.Source != "replaced" {
+		t.Errorf("match(example.com) source = %q, want replaced", rule.Source)
+	}
+
+	tree.remove("example.com")
+	if tree.size != 1 {
+		t.Fatalf("size = %d, want 1", tree.size)
+	}
+	if _, ok := tree.match("www.example.com"); ok {
+		t.Error("match(www.example.com) after remove, want no match")
+	}
+	if rule, ok := tree.match("x.ads.example.com"); !ok || rule.Key != ".ads.example.com" {
+		t.Errorf("match(x.ads.example.com) = %q, %v, want .ads.example.com", rule.Key, ok)
+	}
+
+	tree.remove("missing.example.com")
+	tree.remove("ads.example.com")
+	if tree.size != 0 {
+		t.Fatalf("size = %d, want 0", tree.size)
+	}
+	if len(tree.root.children) != 0 {
+		t.Errorf("root has %d children after removing every domain, want 0", len(tree.root.children))
+	}
+}
@@ -3,7 +3,7 @@ module github.com/frengky/adblockr
 go 1.15
 
 require (
-	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/boltdb/bolt v1.3.1
 	github.com/gobwas/glob v0.2.3
 	github.com/joyrexus/buckets v0.0.0-20160226012405-95fcbf1aabe4
 	github.com/miekg/dns v1.1.35
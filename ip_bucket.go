@@ -0,0 +1,133 @@
+package adblockr
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ipTable holds the networks of one address family by prefix length, keyed by the network address.
+type ipTable struct {
+	bits     int
+	prefixes map[int]map[string]Rule
+	lengths  []int // longest prefix first
+}
+
+func newIPTable(bits int) *ipTable {
+	return &ipTable{bits: bits, prefixes: make(map[int]map[string]Rule)}
+}
+
+func (t *ipTable) put(network *net.IPNet, rule Rule) bool {
+	ones, _ := network.Mask.Size()
+	rules, ok := t.prefixes[ones]
+	if !ok {
+		rules = make(map[string]Rule)
+		t.prefixes[ones] = rules
+		t.lengths = append(t.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	key := network.IP.String()
+	_, exists := rules[key]
+	rules[key] = rule
+	return !exists
+}
+
+func (t *ipTable) match(ip net.IP) (Rule, bool) {
+	for _, ones := range t.lengths {
+		if rule, ok := t.prefixes[ones][ip.Mask(net.CIDRMask(ones, t.bits)).String()]; ok {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// IPBucket holds blocked addresses and networks, answers resolving to one of them are blocked.
+type IPBucket struct {
+	mu   sync.RWMutex
+	v4   *ipTable
+	v6   *ipTable
+	size int
+}
+
+func NewIPBucket() *IPBucket {
+	return &IPBucket{v4: newIPTable(32), v6: newIPTable(128)}
+}
+
+// ParseIPNetwork parses an address or a CIDR, an address is a network of a single address.
+func ParseIPNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		return network, err
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Put adds a rule, its Key is an address or a CIDR.
+func (b *IPBucket) Put(rule Rule) error {
+	network, err := ParseIPNetwork(rule.Key)
+	if err != nil {
+		return err
+	}
+	table := b.v6
+	if _, bits := network.Mask.Size(); bits == 32 {
+		table = b.v4
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if table.put(network, rule) {
+		b.size++
+	}
+	return nil
+}
+
+// Match returns the rule of the most specific network containing ip.
+func (b *IPBucket) Match(ip net.IP) (Rule, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		return b.v4.match(ip4)
+	}
+	return b.v6.match(ip)
+}
+
+func (b *IPBucket) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.size
+}
+
+// LoadIPRules reads a list of addresses and CIDRs, one per line. Text after the first field is ignored,
+// so hosts style lines and lists with comments or trailing columns like "1.2.3.0/24 ; SBL123" work.
+func LoadIPRules(list io.Reader, source string, bucket *IPBucket) (int, error) {
+	count := 0
+	invalid := 0
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		if err := bucket.Put(Rule{Key: strings.TrimRight(fields[0], ";,"), Source: source}); err != nil {
+			invalid++
+			continue
+		}
+		count++
+	}
+	if invalid > 0 {
+		log.WithFields(log.Fields{"source": source, "count": invalid}).Warn("invalid addresses skipped")
+	}
+	return count, scanner.Err()
+}
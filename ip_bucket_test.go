@@ -0,0 +1,80 @@
+package adblockr
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPBucketMatch(t *testing.T) {
+	list := `# blocked networks
+10.0.0.0/8 ; private
+10.1.0.0/16
+10.1.2.3
+203.0.113.0/24; SBL123
+2001:db8::/32
+2001:db8:1::/48,
+0.0.0.0 ads.example.com
+;SBL comment
+not-an-address
+10.0.0.0/33
+`
+	b := NewIPBucket()
+	count, err := LoadIPRules(strings.NewReader(list), "test", b)
+	if err != nil || count != 7 || b.Len() != 7 {
+		t.Fatalf("LoadIPRules() = %d, %v with %d rules, want 7", count, err, b.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		rule string
+		ok   bool
+	}{
+		{"10.1.2.3", "10.1.2.3", true},
+		{"10.1.2.4", "10.1.0.0/16", true},
+		{"10.2.0.1", "10.0.0.0/8", true},
+		{"::ffff:10.2.0.1", "10.0.0.0/8", true},
+		{"203.0.113.200", "203.0.113.0/24", true},
+		{"0.0.0.0", "0.0.0.0", true},
+		{"11.0.0.1", "", false},
+		{"2001:db8:1::1", "2001:db8:1::/48", true},
+		{"2001:db8:2::1", "2001:db8::/32", true},
+		{"2001:db9::1", "", false},
+		{"::", "", false},
+	}
+	for _, tt := range tests {
+		rule, ok := b.Match(net.ParseIP(tt.ip))
+		if ok != tt.ok || rule.Key != tt.rule {
+			t.Errorf("Match(%s) = %q, %v, want %q, %v", tt.ip, rule.Key, ok, tt.rule, tt.ok)
+		}
+		if ok && rule.Source != "test" {
+			t.Errorf("Match(%s) source = %q, want test", tt.ip, rule.Source)
+		}
+	}
+}
+
+func TestParseIPNetwork(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+		err   bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"192.0.2.1/24", "192.0.2.0/24", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::1/64", "2001:db8::/64", false},
+		{"192.0.2.256", "", true},
+		{"192.0.2.0/", "", true},
+		{"example.com", "", true},
+	}
+	for _, tt := range tests {
+		network, err := ParseIPNetwork(tt.entry)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseIPNetwork(%q) error = %v, want error %v", tt.entry, err, tt.err)
+			continue
+		}
+		if err == nil && network.String() != tt.want {
+			t.Errorf("ParseIPNetwork(%q) = %s, want %s", tt.entry, network, tt.want)
+		}
+	}
+}
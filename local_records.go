@@ -0,0 +1,179 @@
+package adblockr
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// HostsTTL is the TTL of records read from hosts files.
+var HostsTTL uint32 = 300
+
+// maxLocalCNAMEs limits how many local CNAMEs are followed for a single answer.
+const maxLocalCNAMEs = 8
+
+// LocalRecords are answered authoritatively instead of asking the upstreams, a PTR record
+// is generated for every A and AAAA record.
+type LocalRecords struct {
+	mu      sync.RWMutex
+	records map[string][]dns.RR
+}
+
+func NewLocalRecords() *LocalRecords {
+	return &LocalRecords{records: make(map[string][]dns.RR)}
+}
+
+// AddRecord adds a record in zone file format, e.g. "nas.lan. 300 IN A 192.168.1.10".
+func (l *LocalRecords) AddRecord(record string) error {
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		return fmt.Errorf("empty record")
+	}
+	switch rr.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypePTR, dns.TypeSRV:
+	default:
+		return fmt.Errorf("unsupported record type: %s", dns.TypeToString[rr.Header().Rrtype])
+	}
+	l.Add(rr)
+	return nil
+}
+
+// Add adds a record, together with its PTR record for A and AAAA records.
+func (l *LocalRecords) Add(rr dns.RR) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.add(rr)
+
+	var ip net.IP
+	switch r := rr.(type) {
+	case *dns.A:
+		ip = r.A
+	case *dns.AAAA:
+		ip = r.AAAA
+	default:
+		return
+	}
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	l.add(&dns.PTR{
+		Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+		Ptr: dns.Fqdn(rr.Header().Name),
+	})
+}
+
+func (l *LocalRecords) add(rr dns.RR) {
+	name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+	for _, existing := range l.records[name] {
+		if dns.IsDuplicate(existing, rr) {
+			return
+		}
+	}
+	l.records[name] = append(l.records[name], rr)
+}
+
+// LoadHosts adds the addresses of a hosts file, every line is an address followed by its names.
+func (l *LocalRecords) LoadHosts(hosts io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(hosts)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: HostsTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				l.Add(&dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				l.Add(&dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (l *LocalRecords) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	n := 0
+	for _, rrs := range l.records {
+		n += len(rrs)
+	}
+	return n
+}
+
+// Answer returns an authoritative reply when the question is a local name, a name without records
+// of the requested type is answered with no data. Local CNAMEs are followed, the returned target
+// is not empty when the chain ends at a name which is not local.
+func (l *LocalRecords) Answer(r *dns.Msg) (*dns.Msg, string, bool) {
+	if l == nil || len(r.Question) == 0 {
+		return nil, "", false
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		return nil, "", false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	name := strings.ToLower(q.Name)
+	if _, ok := l.records[name]; !ok {
+		return nil, "", false
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	for i := 0; i <= maxLocalCNAMEs; i++ {
+		rrs, ok := l.records[name]
+		if !ok {
+			return m, name, true
+		}
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+				m.Answer = append(m.Answer, answerRR(rr, q.Name, i == 0))
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if cname == nil {
+			return m, "", true
+		}
+		m.Answer = append(m.Answer, answerRR(cname, q.Name, i == 0))
+		name = strings.ToLower(cname.Target)
+	}
+	return m, "", true
+}
+
+// answerRR copies a record, the owner name of the question keeps the case of the query.
+func answerRR(rr dns.RR, qName string, first bool) dns.RR {
+	rr = dns.Copy(rr)
+	if first {
+		rr.Header().Name = qName
+	}
+	return rr
+}
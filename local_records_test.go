@@ -0,0 +1,126 @@
+package adblockr
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestLocalRecordsAnswer(t *testing.T) {
+	l := NewLocalRecords()
+	for _, record := range []string{
+		"nas.lan. 300 IN A 192.168.1.10",
+		"nas.lan. 300 IN AAAA fd00::10",
+		"files.lan. 300 IN CNAME nas.lan.",
+		"share.lan. 300 IN CNAME files.lan.",
+		"docs.lan. 300 IN CNAME docs.example.com.",
+		"loop1.lan. 300 IN CNAME loop2.lan.",
+		"loop2.lan. 300 IN CNAME loop1.lan.",
+	} {
+		if err := l.AddRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		qType   uint16
+		ok      bool
+		answers int
+		target  string
+	}{
+		{"nas.lan.", dns.TypeA, true, 1, ""},
+		{"NAS.lan.", dns.TypeAAAA, true, 1, ""},
+		{"nas.lan.", dns.TypeANY, true, 2, ""},
+		{"nas.lan.", dns.TypeTXT, true, 0, ""},
+		{"files.lan.", dns.TypeA, true, 2, ""},
+		{"share.lan.", dns.TypeA, true, 3, ""},
+		{"docs.lan.", dns.TypeA, true, 1, "docs.example.com."},
+		{"loop1.lan.", dns.TypeA, true, maxLocalCNAMEs + 1, ""},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, true, 1, ""},
+		{"other.lan.", dns.TypeA, false, 0, ""},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qType)
+		m, target, ok := l.Answer(r)
+		if ok != tt.ok || target != tt.target {
+			t.Errorf("Answer(%s %s) = %v, %q, want %v, %q", tt.name, dns.TypeToString[tt.qType], ok, target, tt.ok, tt.target)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if len(m.Answer) != tt.answers || !m.Authoritative || m.Rcode != dns.RcodeSuccess {
+			t.Errorf("Answer(%s %s) = %v, want %d authoritative answers", tt.name, dns.TypeToString[tt.qType], m.Answer, tt.answers)
+			continue
+		}
+		if tt.answers > 0 && m.Answer[0].Header().Name != tt.name {
+			t.Errorf("Answer(%s %s) owner %q, want the case of the query", tt.name, dns.TypeToString[tt.qType], m.Answer[0].Header().Name)
+		}
+	}
+}
+
+func TestLocalRecordsAddRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		err    bool
+	}{
+		{"nas.lan. 300 IN A 192.168.1.10", false},
+		{"nas.lan. IN TXT \"storage\"", false},
+		{"_http._tcp.lan. 300 IN SRV 0 0 80 nas.lan.", false},
+		{"lan. 300 IN MX 10 mail.lan.", true},
+		{"nas.lan. 300 IN A not-an-ip", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if err := NewLocalRecords().AddRecord(tt.record); (err != nil) != tt.err {
+			t.Errorf("AddRecord(%q) error = %v, want error %v", tt.record, err, tt.err)
+		}
+	}
+}
+
+func TestLocalRecordsLoadHosts(t *testing.T) {
+	hosts := `# local hosts
+127.0.0.1 localhost
+192.168.1.10  nas nas.lan   # storage
+fd00::20 printer.lan
+not-an-ip broken.lan
+192.168.1.30
+`
+	l := NewLocalRecords()
+	count, err := l.LoadHosts(strings.NewReader(hosts))
+	if err != nil || count != 4 {
+		t.Fatalf("LoadHosts() = %d, %v, want 4", count, err)
+	}
+
+	tests := []struct {
+		name  string
+		qType uint16
+		want  []string
+	}{
+		{"nas.", dns.TypeA, []string{"192.168.1.10"}},
+		{"nas.lan.", dns.TypeA, []string{"192.168.1.10"}},
+		{"printer.lan.", dns.TypeAAAA, []string{"fd00::20"}},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"nas.", "nas.lan."}},
+		{"broken.lan.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qType)
+		m, _, ok := l.Answer(r)
+		var got []string
+		if ok {
+			for _, rr := range m.Answer {
+				got = append(got, strings.TrimPrefix(rr.String(), rr.Header().String()))
+				if rr.Header().Ttl != HostsTTL {
+					t.Errorf("%s: ttl %d, want %d", tt.name, rr.Header().Ttl, HostsTTL)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s %s = %v, want %v", tt.name, dns.TypeToString[tt.qType], got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package adblockr
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key        string
+	value      interface{}
+	expiration int64
+}
+
+func (e *lruEntry) expired(now int64) bool {
+	return e.expiration > 0 && now > e.expiration
+}
+
+// LRUCache is an AnswerCache holding at most maxEntries answers,
+// the least recently used answer is evicted to make room for a new one.
+type LRUCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewLRUCache(maxEntries int) *LRUCache {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &LRUCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if e.expired(time.Now().UnixNano()) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Set stores value for d, a duration of zero or less never expires.
+func (c *LRUCache) Set(key string, value interface{}, d time.Duration) {
+	var expiration int64
+	if d > 0 {
+		expiration = time.Now().Add(d).UnixNano()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value, e.expiration = value, expiration
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expiration: expiration})
+	for c.ll.Len() > c.maxEntries {
+		c.remove(c.ll.Back())
+		metricCacheEvictions.inc()
+	}
+}
+
+// Entries returns a copy of all answers which did not expire yet.
+func (c *LRUCache) Entries() map[string]CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UnixNano()
+	entries := make(map[string]CacheEntry, len(c.items))
+	for key, el := range c.items {
+		e := el.Value.(*lruEntry)
+		if e.expired(now) {
+			continue
+		}
+		entry := CacheEntry{Value: e.value}
+		if e.expiration > 0 {
+			entry.Expiration = time.Unix(0, e.expiration)
+		}
+		entries[key] = entry
+	}
+	return entries
+}
+
+// ItemCount returns the number of answers in the cache, including expired ones not evicted yet.
+func (c *LRUCache) ItemCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *LRUCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
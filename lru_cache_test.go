@@ -0,0 +1,73 @@
+package adblockr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := NewLRUCache(2)
+	c.Set("a", 1, time.Minute)
+	c.Set("b", 2, time.Minute)
+	c.Get("a")
+	c.Set("c", 3, time.Minute)
+
+	tests := []struct {
+		key   string
+		value interface{}
+		found bool
+	}{
+		{"a", 1, true},
+		{"b", nil, false},
+		{"c", 3, true},
+	}
+	for _, tt := range tests {
+		value, found := c.Get(tt.key)
+		if found != tt.found || value != tt.value {
+			t.Errorf("Get(%q) = %v, %v, want %v, %v", tt.key, value, found, tt.value, tt.found)
+		}
+	}
+	if n := c.ItemCount(); n != 2 {
+		t.Errorf("ItemCount() = %d, want 2", n)
+	}
+
+	c.Set("a", 4, time.Minute)
+	if value, _ := c.Get("a"); value != 4 || c.ItemCount() != 2 {
+		t.Errorf("Get(a) = %v with %d items after replacing it, want 4 with 2 items", value, c.ItemCount())
+	}
+
+	c.Flush()
+	if _, found := c.Get("a"); found || c.ItemCount() != 0 {
+		t.Errorf("%d items after Flush, want none", c.ItemCount())
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Set("expired", 1, time.Nanosecond)
+	c.Set("fresh", 2, time.Minute)
+	c.Set("forever", 3, 0)
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		key   string
+		found bool
+	}{
+		{"expired", false},
+		{"fresh", true},
+		{"forever", true},
+	}
+	for _, tt := range tests {
+		if _, found := c.Get(tt.key); found != tt.found {
+			t.Errorf("Get(%q) found = %v, want %v", tt.key, found, tt.found)
+		}
+	}
+
+	entries := c.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Entries() = %v, want fresh and forever", entries)
+	}
+	if entries["fresh"].Expiration.IsZero() || !entries["forever"].Expiration.IsZero() {
+		t.Errorf("Entries() expirations = %v, want only fresh to expire", entries)
+	}
+}
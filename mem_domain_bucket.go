@@ -2,94 +2,113 @@ package adblockr
 
 import (
 	"github.com/gobwas/glob"
-	"io"
 	"strings"
 	"sync"
 )
 
 func NewMemDomainBucket() DomainBucket {
 	return &MemDomainBucket{
-		domains:  make(map[string]bool),
-		patterns: make(map[string]glob.Glob),
+		domains:  make(map[string]Rule),
+		patterns: make(map[string]patternRule),
+		suffixes: newDomainTree(),
 		mu:       sync.RWMutex{},
 	}
 }
 
+type patternRule struct {
+	glob glob.Glob
+	rule Rule
+}
+
 type MemDomainBucket struct {
-	domains  map[string]bool
-	patterns map[string]glob.Glob
+	domains  map[string]Rule
+	patterns map[string]patternRule
+	suffixes *domainTree
 	mu       sync.RWMutex
 }
 
-func (m *MemDomainBucket) Put(key string, value bool) error {
+func (m *MemDomainBucket) Put(rule Rule) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if strings.ContainsAny(key, globChars) {
-		g, err := glob.Compile(key)
-		if err != nil {
-			return err
-		}
-		m.patterns[key] = g
-	} else {
-		m.domains[strings.ToLower(key)] = value
-	}
-	return nil
+	return m.putNoLock(rule)
 }
 
-func (m *MemDomainBucket) putNoLock(key string, value bool) error {
-	if strings.ContainsAny(key, globChars) {
-		g, err := glob.Compile(key)
+func (m *MemDomainBucket) putNoLock(rule Rule) error {
+	key := rule.Key
+	if isSuffixKey(key) {
+		rule.Key = strings.ToLower(key)
+		m.suffixes.insert(rule.Key[1:], rule)
+	} else if isPatternKey(key) {
+		g, err := compilePattern(key)
 		if err != nil {
 			return err
 		}
-		m.patterns[key] = g
+		m.patterns[key] = patternRule{glob: g, rule: rule}
 	} else {
-		m.domains[strings.ToLower(key)] = value
+		rule.Key = strings.ToLower(key)
+		m.domains[rule.Key] = rule
 	}
 	return nil
 }
 
 func (m *MemDomainBucket) Has(domain string) bool {
+	_, ok := m.Match(domain)
+	return ok
+}
+
+func (m *MemDomainBucket) Match(domain string) (Rule, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	var found ruleMatch
 	domain = strings.ToLower(domain)
-	_, ok := m.domains[domain]
-	if ok {
-		return true
+	if rule, ok := m.domains[domain]; ok && found.add(rule) {
+		return found.rule, true
 	}
 
-	for _, g := range m.patterns {
-		if g.Match(domain) {
-			return true
+	if rule, ok := m.suffixes.match(domain); ok && found.add(rule) {
+		return found.rule, true
+	}
+
+	for _, p := range m.patterns {
+		if p.glob.Match(domain) && found.add(p.rule) {
+			return found.rule, true
 		}
 	}
-	return false
+	return found.rule, found.ok
 }
 
 func (m *MemDomainBucket) Forget(key string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if strings.ContainsAny(key, globChars) {
+	if isSuffixKey(key) {
+		m.suffixes.remove(strings.ToLower(key[1:]))
+	} else if isPatternKey(key) {
 		delete(m.patterns, key)
 	} else {
 		delete(m.domains, strings.ToLower(key))
 	}
 }
 
-func (m *MemDomainBucket) Update(list io.Reader) (int, error) {
-	count, err := ParseLine(list, func(line string) bool {
-		if err := m.putNoLock(line, true); err == nil {
-			return true
-		}
-		return false
-	})
+func (m *MemDomainBucket) Update(rules []Rule) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if err != nil {
-		return 0, err
+	count := 0
+	for _, rule := range rules {
+		if err := m.putNoLock(rule); err == nil {
+			count++
+		}
 	}
 
 	return count, nil
 }
+
+func (m *MemDomainBucket) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.domains) + len(m.patterns) + m.suffixes.size
+}
@@ -0,0 +1,277 @@
+package adblockr
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var (
+	metricQueries = newCounterVec("adblockr_queries_total",
+		"Number of dns queries received.", "network", "type")
+	metricQueryResults = newCounterVec("adblockr_query_results_total",
+		"Number of dns queries by filter result.", "result")
+	metricCacheHits = newCounterVec("adblockr_cache_hits_total",
+		"Number of dns queries answered from the cache.")
+	metricCacheMisses = newCounterVec("adblockr_cache_misses_total",
+		"Number of dns queries not found in the cache.")
+	metricCachePrefetches = newCounterVec("adblockr_cache_prefetches_total",
+		"Number of popular cache entries refreshed before expiry.")
+	metricCacheStale = newCounterVec("adblockr_cache_stale_answers_total",
+		"Number of dns queries answered with an expired cache entry.")
+	metricCacheEvictions = newCounterVec("adblockr_cache_evictions_total",
+		"Number of answers evicted from a full cache.")
+	metricUpstreamDuration = newHistogramVec("adblockr_upstream_request_duration_seconds",
+		"Latency of upstream nameserver requests.", defaultDurationBuckets, "upstream")
+	metricUpstreamErrors = newCounterVec("adblockr_upstream_errors_total",
+		"Number of upstream nameserver requests failed by a network error or timeout.", "upstream")
+)
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metricWriter
+)
+
+func registerMetric(m metricWriter) {
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	label string
+	value func() map[string]float64
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.value()
+	for _, key := range sortedKeys(values) {
+		labels := ""
+		if g.label != "" {
+			labels = formatLabels([]string{g.label}, []string{key})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+// NewMetricsHandler serves all metrics and the state of the server in the prometheus text format.
+func NewMetricsHandler(server *Server) http.Handler {
+	gauges := []metricWriter{
+		&gauge{
+			name:  "adblockr_blocklist_entries",
+			help:  "Number of entries in the domain and ip buckets.",
+			label: "bucket",
+			value: func() map[string]float64 {
+				entries := map[string]float64{
+					"blacklist": float64(server.Blacklist().Len()),
+					"whitelist": float64(server.Whitelist().Len()),
+				}
+				if ipBlacklist := server.IPBlacklist(); ipBlacklist != nil {
+					entries["ip_blacklist"] = float64(ipBlacklist.Len())
+				}
+				return entries
+			},
+		},
+		&gauge{
+			name: "adblockr_cache_entries",
+			help: "Number of answers in the cache.",
+			value: func() map[string]float64 {
+				return map[string]float64{"": float64(server.cache.ItemCount())}
+			},
+		},
+		&gauge{
+			name:  "adblockr_upstream_healthy",
+			help:  "Whether an upstream nameserver is used in its configured order (1) or skipped as unhealthy (0).",
+			label: "upstream",
+			value: func() map[string]float64 {
+				values := make(map[string]float64)
+				for _, status := range resolverHealth(server) {
+					values[status.Upstream] = 0
+					if status.Healthy {
+						values[status.Upstream] = 1
+					}
+				}
+				return values
+			},
+		},
+		&gauge{
+			name:  "adblockr_upstream_rtt_seconds",
+			help:  "Moving average of the round trip time to an upstream nameserver.",
+			label: "upstream",
+			value: func() map[string]float64 {
+				values := make(map[string]float64)
+				for _, status := range resolverHealth(server) {
+					values[status.Upstream] = status.RTT.Seconds()
+				}
+				return values
+			},
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metricsMu.Lock()
+		registered := append([]metricWriter{}, metrics...)
+		metricsMu.Unlock()
+		for _, m := range append(registered, gauges...) {
+			m.writeTo(w)
+		}
+	})
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels string, name string, value string) string {
+	pair := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func resolverHealth(server *Server) []UpstreamStatus {
+	if reporter, ok := server.Resolver().(HealthReporter); ok {
+		return reporter.Health()
+	}
+	return nil
+}
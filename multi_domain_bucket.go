@@ -0,0 +1,48 @@
+package adblockr
+
+// MultiDomainBucket matches a domain against all of its buckets,
+// new entries are stored to the first bucket.
+type MultiDomainBucket struct {
+	buckets []DomainBucket
+}
+
+func NewMultiDomainBucket(buckets ...DomainBucket) DomainBucket {
+	return &MultiDomainBucket{buckets: buckets}
+}
+
+func (m *MultiDomainBucket) Put(rule Rule) error {
+	return m.buckets[0].Put(rule)
+}
+
+func (m *MultiDomainBucket) Has(domain string) bool {
+	_, ok := m.Match(domain)
+	return ok
+}
+
+func (m *MultiDomainBucket) Match(domain string) (Rule, bool) {
+	var found ruleMatch
+	for _, b := range m.buckets {
+		if rule, ok := b.Match(domain); ok && found.add(rule) {
+			break
+		}
+	}
+	return found.rule, found.ok
+}
+
+func (m *MultiDomainBucket) Forget(key string) {
+	for _, b := range m.buckets {
+		b.Forget(key)
+	}
+}
+
+func (m *MultiDomainBucket) Update(rules []Rule) (int, error) {
+	return m.buckets[0].Update(rules)
+}
+
+func (m *MultiDomainBucket) Len() int {
+	n := 0
+	for _, b := range m.buckets {
+		n += b.Len()
+	}
+	return n
+}
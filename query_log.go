@@ -0,0 +1,281 @@
+package adblockr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queryLogDayFormat     = "2006-01-02"
+	queryLogFlushInterval = 2 * time.Second
+	queryLogQueueSize     = 4096
+	queryLogOpenTimeout   = 5 * time.Second
+	// queryLogMaxPending limits the entries kept while the database cannot be written
+	queryLogMaxPending = 16 * queryLogQueueSize
+)
+
+type QueryLogEntry struct {
+	Time     time.Time     `json:"time"`
+	ClientIP string        `json:"client_ip"`
+	Network  string        `json:"net"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Rcode    string        `json:"rcode"`
+	Answer   []string      `json:"answer,omitempty"`
+	Rule     string        `json:"rule,omitempty"`
+	Source   string        `json:"source,omitempty"`
+	CNAME    string        `json:"cname,omitempty"`
+	IP       string        `json:"ip,omitempty"`
+	Upstream string        `json:"upstream,omitempty"`
+	Latency  time.Duration `json:"latency"`
+	Cached   bool          `json:"cached,omitempty"`
+}
+
+func (e *QueryLogEntry) setReply(m *dns.Msg) {
+	e.Rcode = dns.RcodeToString[m.Rcode]
+	e.Answer = e.Answer[:0]
+	for _, rr := range m.Answer {
+		e.Answer = append(e.Answer, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+}
+
+// QueryLog stores query log entries in a bolt database with one bucket per day,
+// the database is only kept open while writing so it can be read while the server is running.
+type QueryLog struct {
+	filepath  string
+	retention time.Duration
+	entries   chan QueryLogEntry
+	quit      chan struct{}
+	wg        sync.WaitGroup
+	lastPurge time.Time
+}
+
+func NewQueryLog(filepath string, retention time.Duration) *QueryLog {
+	q := &QueryLog{
+		filepath:  filepath,
+		retention: retention,
+		entries:   make(chan QueryLogEntry, queryLogQueueSize),
+		quit:      make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+func (q *QueryLog) Add(entry QueryLogEntry) {
+	select {
+	case q.entries <- entry:
+	default:
+		log.Warn("query log queue is full, entry dropped")
+	}
+}
+
+func (q *QueryLog) Close() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+func (q *QueryLog) run() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+
+	// a failed batch is kept and written again on the next tick, e.g. while a reader holds the database
+	var batch []QueryLogEntry
+	failing := false
+	for {
+		select {
+		case entry := <-q.entries:
+			batch = append(batch, entry)
+			if len(batch) > queryLogMaxPending {
+				log.WithField("count", len(batch)-queryLogMaxPending).Warn("query log is not writable, oldest entries dropped")
+				batch = append(batch[:0], batch[len(batch)-queryLogMaxPending:]...)
+			}
+			if len(batch) >= queryLogQueueSize && !failing {
+				batch, failing = q.write(batch)
+			}
+		case <-ticker.C:
+			batch, failing = q.write(batch)
+		case <-q.quit:
+			for {
+				select {
+				case entry := <-q.entries:
+					batch = append(batch, entry)
+				default:
+					q.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// write flushes the batch, it returns the emptied batch or the unchanged one when writing failed.
+func (q *QueryLog) write(batch []QueryLogEntry) ([]QueryLogEntry, bool) {
+	if err := q.flush(batch); err != nil {
+		return batch, true
+	}
+	return batch[:0], false
+}
+
+func (q *QueryLog) flush(batch []QueryLogEntry) error {
+	purge := q.retention > 0 && time.Since(q.lastPurge) > time.Hour
+	if len(batch) == 0 && !purge {
+		return nil
+	}
+
+	db, err := bolt.Open(q.filepath, 0600, &bolt.Options{Timeout: queryLogOpenTimeout})
+	if err != nil {
+		log.WithField("file", q.filepath).WithError(err).Error("unable to open query log")
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range batch {
+			b, err := tx.CreateBucketIfNotExists([]byte(entry.Time.UTC().Format(queryLogDayFormat)))
+			if err != nil {
+				return err
+			}
+			seq, _ := b.NextSequence()
+			value, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if err := b.Put(queryLogKey(entry.Time, seq), value); err != nil {
+				return err
+			}
+		}
+
+		if purge {
+			oldest := time.Now().Add(-q.retention).UTC().Format(queryLogDayFormat)
+			var expired [][]byte
+			_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				if string(name) < oldest {
+					expired = append(expired, append([]byte{}, name...))
+				}
+				return nil
+			})
+			for _, name := range expired {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+				log.WithField("day", string(name)).Debug("query log expired")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithField("file", q.filepath).WithError(err).Error("unable to write query log")
+		return err
+	}
+	if purge {
+		q.lastPurge = time.Now()
+	}
+	return nil
+}
+
+func queryLogKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// QueryLogFilter selects query log entries, empty fields match everything.
+type QueryLogFilter struct {
+	ClientIP string
+	Domain   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f QueryLogFilter) match(e QueryLogEntry) bool {
+	if f.ClientIP != "" && e.ClientIP != f.ClientIP {
+		return false
+	}
+	if f.Domain != "" {
+		name := strings.ToLower(unFqdn(e.Name))
+		domain := strings.ToLower(f.Domain)
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadQueryLog returns the entries matching the filter in chronological order, with a Limit only the latest ones.
+// The entries are read from the newest backwards so a short read blocks the writer of a running server only briefly.
+func ReadQueryLog(filepath string, filter QueryLogFilter) ([]QueryLogEntry, error) {
+	if _, err := os.Stat(filepath); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath, 0600, &bolt.Options{ReadOnly: true, Timeout: queryLogOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	until := filter.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	minKey, minDay := make([]byte, 16), ""
+	if !filter.Since.IsZero() {
+		minKey = queryLogKey(filter.Since, 0)
+		minDay = filter.Since.UTC().Format(queryLogDayFormat)
+	}
+	maxKey := queryLogKey(until, ^uint64(0))
+	maxDay := until.UTC().Format(queryLogDayFormat)
+
+	var entries []QueryLogEntry
+	full := func() bool {
+		return filter.Limit > 0 && len(entries) >= filter.Limit
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		days := tx.Cursor()
+		for name, _ := days.Last(); name != nil && !full(); name, _ = days.Prev() {
+			if day := string(name); day < minDay || day > maxDay {
+				continue
+			}
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			k, v := c.Seek(maxKey)
+			if k == nil {
+				k, v = c.Last()
+			} else if bytes.Compare(k, maxKey) > 0 {
+				k, v = c.Prev()
+			}
+			for ; k != nil && bytes.Compare(k, minKey) >= 0 && !full(); k, v = c.Prev() {
+				var entry QueryLogEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					continue
+				}
+				if filter.match(entry) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package adblockr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryLogFilterMatch(t *testing.T) {
+	entry := QueryLogEntry{ClientIP: "192.168.1.10", Name: "ads.Example.com."}
+	tests := []struct {
+		filter QueryLogFilter
+		want   bool
+	}{
+		{QueryLogFilter{}, true},
+		{QueryLogFilter{ClientIP: "192.168.1.10"}, true},
+		{QueryLogFilter{ClientIP: "192.168.1.11"}, false},
+		{QueryLogFilter{Domain: "example.com"}, true},
+		{QueryLogFilter{Domain: "ads.example.com"}, true},
+		{QueryLogFilter{Domain: "EXAMPLE.com"}, true},
+		{QueryLogFilter{Domain: "ple.com"}, false},
+		{QueryLogFilter{Domain: "www.ads.example.com"}, false},
+		{QueryLogFilter{ClientIP: "192.168.1.10", Domain: "example.org"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(entry); got != tt.want {
+			t.Errorf("%+v.match() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestReadQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "query.db")
+
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	q := NewQueryLog(file, 0)
+	q.Add(QueryLogEntry{Time: yesterday, ClientIP: "10.0.0.1", Name: "old.example.com."})
+	q.Add(QueryLogEntry{Time: now.Add(-3 * time.Minute), ClientIP: "10.0.0.1", Name: "a.example.com."})
+	q.Add(QueryLogEntry{Time: now.Add(-2 * time.Minute), ClientIP: "10.0.0.2", Name: "b.example.org."})
+	q.Add(QueryLogEntry{Time: now.Add(-1 * time.Minute), ClientIP: "10.0.0.1", Name: "c.example.com."})
+	q.Close()
+
+	tests := []struct {
+		filter QueryLogFilter
+		want   []string
+	}{
+		{QueryLogFilter{}, []string{"old.example.com.", "a.example.com.", "b.example.org.", "c.example.com."}},
+		{QueryLogFilter{Limit: 2}, []string{"b.example.org.", "c.example.com."}},
+		{QueryLogFilter{Limit: 2, ClientIP: "10.0.0.1"}, []string{"a.example.com.", "c.example.com."}},
+		{QueryLogFilter{Domain: "example.org"}, []string{"b.example.org."}},
+		{QueryLogFilter{Since: now.Add(-150 * time.Second)}, []string{"b.example.org.", "c.example.com."}},
+		{QueryLogFilter{Until: now.Add(-150 * time.Second)}, []string{"old.example.com.", "a.example.com."}},
+		{QueryLogFilter{Until: yesterday.Add(time.Second), Limit: 5}, []string{"old.example.com."}},
+	}
+	for _, tt := range tests {
+		entries, err := ReadQueryLog(file, tt.filter)
+		if err != nil {
+			t.Fatalf("ReadQueryLog(%+v) error = %v", tt.filter, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if len(names) != len(tt.want) {
+			t.Errorf("ReadQueryLog(%+v) = %v, want %v", tt.filter, names, tt.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Errorf("ReadQueryLog(%+v) = %v, want %v", tt.filter, names, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestQueryLogWriteKeepsFailedBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory can not be opened as database
+	q := &QueryLog{filepath: dir}
+	batch, failing := q.write([]QueryLogEntry{{Time: time.Now(), Name: "a.example.com."}})
+	if !failing || len(batch) != 1 {
+		t.Fatalf("write() = %d entries, failing %v, want 1 entry kept", len(batch), failing)
+	}
+
+	q.filepath = filepath.Join(dir, "query.db")
+	if batch, failing = q.write(batch); failing || len(batch) != 0 {
+		t.Fatalf("write() = %d entries, failing %v, want the batch written", len(batch), failing)
+	}
+	entries, err := ReadQueryLog(q.filepath, QueryLogFilter{})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadQueryLog() = %d entries, %v, want 1", len(entries), err)
+	}
+}
@@ -9,8 +9,14 @@ import (
 	"time"
 )
 
+// Resolver looks up a request from an upstream, it returns the answer and the upstream which answered it.
 type Resolver interface {
-	Lookup(net string, req *dns.Msg) (*dns.Msg, error)
+	Lookup(net string, req *dns.Msg) (*dns.Msg, string, error)
+}
+
+type upstreamAnswer struct {
+	msg      *dns.Msg
+	upstream string
 }
 
 type defaultResolver struct {
@@ -19,10 +25,19 @@ type defaultResolver struct {
 	timeout     int
 	client      *dns.Client
 	tlsClient   *dns.Client
+	health      *upstreamHealth
+	selector    *upstreamSelector
 }
 
 func NewResolver(nameservers []string, intervalMs int, timeoutMs int) Resolver {
-	return &defaultResolver{
+	return NewStrategyResolver(nameservers, StrategySequential, nil, intervalMs, timeoutMs)
+}
+
+// NewStrategyResolver creates a resolver asking the nameservers by strategy, weights are only used
+// by StrategyRandom. Unhealthy nameservers are always asked last. Every nameserver is probed in
+// the background until the resolver is closed.
+func NewStrategyResolver(nameservers []string, strategy Strategy, weights map[string]int, intervalMs int, timeoutMs int) Resolver {
+	r := &defaultResolver{
 		nameservers: nameservers,
 		interval:    intervalMs,
 		timeout:     timeoutMs,
@@ -37,12 +52,52 @@ func NewResolver(nameservers []string, intervalMs int, timeoutMs int) Resolver {
 			WriteTimeout: time.Duration(timeoutMs) * time.Millisecond,
 		},
 	}
+	r.health = newUpstreamHealth(nameservers, r.probe)
+	r.health.start()
+	r.selector = newUpstreamSelector(strategy, weights)
+	return r
+}
+
+// Close stops probing the nameservers.
+func (r *defaultResolver) Close() error {
+	r.health.stop()
+	return nil
+}
+
+func (r *defaultResolver) exchange(req *dns.Msg, nameserver string) (*dns.Msg, error) {
+	var rr *dns.Msg
+	var err error
+	if strings.HasSuffix(nameserver, ":853") {
+		rr, _, err = r.tlsClient.Exchange(req, nameserver)
+	} else {
+		rr, _, err = r.client.Exchange(req, nameserver)
+	}
+	return rr, err
+}
+
+// probe checks an upstream by asking for the name servers of the root zone.
+func (r *defaultResolver) probe(nameserver string) error {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	rr, err := r.exchange(req, nameserver)
+	if err != nil {
+		return err
+	}
+	if rr.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("upstream answered %s", dns.RcodeToString[rr.Rcode])
+	}
+	return nil
+}
+
+// Health returns the state of every upstream nameserver.
+func (r *defaultResolver) Health() []UpstreamStatus {
+	return r.health.status()
 }
 
-func (r *defaultResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
+func (r *defaultResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, string, error) {
 	qName := req.Question[0].Name
 
-	res := make(chan *dns.Msg, 1)
+	res := make(chan upstreamAnswer, 1)
 	var wg sync.WaitGroup
 	L := func(nameserver string) {
 		var (
@@ -50,15 +105,17 @@ func (r *defaultResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
 			err error
 		)
 		defer wg.Done()
-		if strings.HasSuffix(nameserver, ":853") {
-			rr, _, err = r.tlsClient.Exchange(req, nameserver)
-		} else {
-			rr, _, err = r.client.Exchange(req, nameserver)
-		}
+		start := time.Now()
+		rr, err = r.exchange(req, nameserver)
 		if err != nil {
+			metricUpstreamErrors.inc(nameserver)
+			r.health.failure(nameserver)
 			log.WithField("ns", nameserver).WithError(err).Error("error while resolving from upstream")
 			return
 		}
+		metricUpstreamDuration.observeSince(start, nameserver)
+		// any answer, even SERVFAIL about a broken name, shows the upstream itself is working
+		r.health.success(nameserver, time.Since(start))
 		if rr != nil && rr.Rcode != dns.RcodeSuccess {
 			log.WithField("ns", nameserver).WithError(err).Warn("invalid answer from upstream")
 			if rr.Rcode == dns.RcodeServerFailure {
@@ -72,20 +129,38 @@ func (r *defaultResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
 			}).Debug("resolving with upstream")
 		}
 		select {
-		case res <- rr:
+		case res <- upstreamAnswer{msg: rr, upstream: nameserver}:
 		default:
 		}
 	}
 
+	healthy, unhealthy := r.health.split()
+	upstreams := append(r.selector.order(healthy, r.health), unhealthy...)
+
+	if r.selector.strategy == StrategyParallel {
+		for _, ns := range upstreams {
+			wg.Add(1)
+			go L(ns)
+		}
+		go func() {
+			wg.Wait()
+			close(res)
+		}()
+		if ans, ok := <-res; ok {
+			return ans.msg, ans.upstream, nil
+		}
+		return nil, "", fmt.Errorf("error while resolving from upstream")
+	}
+
 	ticker := time.NewTicker(time.Duration(r.interval) * time.Millisecond)
 	defer ticker.Stop()
 
-	for _, ns := range r.nameservers {
+	for _, ns := range upstreams {
 		wg.Add(1)
 		go L(ns)
 		select {
-		case msg := <-res:
-			return msg, nil
+		case ans := <-res:
+			return ans.msg, ans.upstream, nil
 		case <-ticker.C:
 			continue
 		}
@@ -93,9 +168,9 @@ func (r *defaultResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
 
 	wg.Wait()
 	select {
-	case msg := <-res:
-		return msg, nil
+	case ans := <-res:
+		return ans.msg, ans.upstream, nil
 	default:
-		return nil, fmt.Errorf("error while resolving from upstream")
+		return nil, "", fmt.Errorf("error while resolving from upstream")
 	}
 }
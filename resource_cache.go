@@ -0,0 +1,140 @@
+package adblockr
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type resourceMeta struct {
+	Uri          string    `json:"uri"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// ResourceCache keeps a copy of every downloaded source with its validators, sources are only
+// downloaded again when changed and the copy is used when a source is unreachable.
+type ResourceCache struct {
+	dir string
+}
+
+func NewResourceCache(dir string) (*ResourceCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ResourceCache{dir: dir}, nil
+}
+
+func (c *ResourceCache) Open(uri string, httpClient *http.Client) (io.ReadCloser, error) {
+	srcUrl, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if srcUrl.Scheme == "file" {
+		return OpenResource(uri, httpClient)
+	}
+
+	sum := sha1.Sum([]byte(uri))
+	name := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+	bodyFile, metaFile := name+".txt", name+".json"
+	logCtx := log.WithField("uri", uri)
+
+	var meta resourceMeta
+	cached := fileExists(bodyFile)
+	if cached {
+		if data, err := ioutil.ReadFile(metaFile); err == nil {
+			_ = json.Unmarshal(data, &meta)
+		}
+	}
+
+	body, err := c.fetch(uri, httpClient, &meta, cached, bodyFile, metaFile)
+	if err == nil {
+		return body, nil
+	}
+	if !cached {
+		return nil, err
+	}
+	logCtx.WithError(err).Warn("source unavailable, using cached copy")
+	return os.Open(bodyFile)
+}
+
+func (c *ResourceCache) fetch(uri string, httpClient *http.Client, meta *resourceMeta, cached bool,
+	bodyFile string, metaFile string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if cached && meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached {
+		log.WithField("uri", uri).Debug("source not modified, using cached copy")
+		return os.Open(bodyFile)
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "text/plain") {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("invalid content type: %s", contentType)
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), bodyFile); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	*meta = resourceMeta{
+		Uri:          uri,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	if data, err := json.Marshal(meta); err == nil {
+		if err := ioutil.WriteFile(metaFile, data, 0644); err != nil {
+			log.WithField("uri", uri).WithError(err).Warn("unable to store source validators")
+		}
+	}
+	return os.Open(bodyFile)
+}
+
+func fileExists(filepath string) bool {
+	info, err := os.Stat(filepath)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,167 @@
+package adblockr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	exceptionPrefix = "@@"
+	importantOption = "important"
+)
+
+var domainPatternRegexp = regexp.MustCompile(`^[a-z0-9_*?.\-]+$`)
+
+// Rule is a single parsed entry of a source list, Key is the DomainBucket key of the rule
+// and Source is the uri of the list it was loaded from.
+type Rule struct {
+	Key       string
+	Source    string
+	Exception bool
+	Important bool
+}
+
+func (r Rule) String() string {
+	s := r.Key
+	switch {
+	case isSuffixKey(s):
+		s = "||" + s[1:] + "^"
+	case isPatternKey(s):
+	case r.Exception || r.Important:
+		s = "|" + s + "^"
+	}
+	if r.Exception {
+		s = exceptionPrefix + s
+	}
+	if r.Important {
+		s = s + "$" + importantOption
+	}
+	return s
+}
+
+// ParseRule parses a hosts file line, a plain domain or the DNS-relevant subset of the adblock syntax:
+// `||domain^`, `|domain^`, `@@` exceptions, `/regex/` and the `$important` modifier.
+// ok is false for blank lines and comments.
+func ParseRule(line string) (rule Rule, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	if isCosmeticRule(line) {
+		return rule, false, fmt.Errorf("unsupported cosmetic rule")
+	}
+
+	if !isAdblockRule(line) {
+		line = strings.TrimSpace(strings.Split(line, "#")[0])
+		if line == "" {
+			return rule, false, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			rule.Key = fields[1]
+		} else {
+			rule.Key = fields[0]
+		}
+		return rule, true, nil
+	}
+
+	if strings.HasPrefix(line, exceptionPrefix) {
+		rule.Exception = true
+		line = line[len(exceptionPrefix):]
+	}
+
+	pattern, options := line, ""
+	if strings.HasPrefix(line, "/") {
+		if i := strings.LastIndex(line, "/"); i > 0 {
+			pattern, options = line[:i+1], line[i+1:]
+		}
+		if options != "" && !strings.HasPrefix(options, "$") {
+			return rule, false, fmt.Errorf("invalid regex rule")
+		}
+		options = strings.TrimPrefix(options, "$")
+	} else if i := strings.LastIndex(line, "$"); i >= 0 {
+		pattern, options = line[:i], line[i+1:]
+	}
+
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			if strings.TrimSpace(option) != importantOption {
+				return rule, false, fmt.Errorf("unsupported modifier: %s", option)
+			}
+			rule.Important = true
+		}
+	}
+
+	if isRegexKey(pattern) {
+		if len(pattern) < 3 {
+			return rule, false, fmt.Errorf("empty regex rule")
+		}
+		rule.Key = pattern
+		return rule, true, nil
+	}
+
+	key, err := adblockPatternKey(pattern)
+	if err != nil {
+		return rule, false, err
+	}
+	rule.Key = key
+	return rule, true, nil
+}
+
+func isAdblockRule(line string) bool {
+	return strings.HasPrefix(line, "||") || strings.HasPrefix(line, "|") ||
+		strings.HasPrefix(line, exceptionPrefix) || strings.HasPrefix(line, "/") ||
+		strings.ContainsAny(line, "^$")
+}
+
+func isCosmeticRule(line string) bool {
+	if strings.ContainsAny(line, " \t") {
+		return false
+	}
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegexKey(key string) bool {
+	return len(key) > 1 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/")
+}
+
+func adblockPatternKey(pattern string) (string, error) {
+	domain, suffix, anchored := pattern, false, false
+	if strings.HasPrefix(domain, "||") {
+		domain, suffix = domain[2:], true
+	} else if strings.HasPrefix(domain, "|") {
+		domain, anchored = domain[1:], true
+	}
+
+	if i := strings.Index(domain, "^"); i >= 0 {
+		if rest := domain[i+1:]; rest != "" && rest != "|" {
+			return "", fmt.Errorf("unsupported url rule")
+		}
+		domain = domain[:i]
+	} else if strings.HasSuffix(domain, "|") {
+		domain = domain[:len(domain)-1]
+	}
+
+	domain = strings.ToLower(domain)
+	if domain == "" || !domainPatternRegexp.MatchString(domain) {
+		return "", fmt.Errorf("unsupported url rule")
+	}
+
+	isGlob := strings.ContainsAny(domain, globChars)
+	switch {
+	case suffix && isGlob:
+		return "{" + domain + ",*." + domain + "}", nil
+	case suffix:
+		return suffixPrefix + domain, nil
+	case anchored:
+		return domain, nil
+	default:
+		return "*" + domain, nil
+	}
+}
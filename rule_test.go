@@ -0,0 +1,72 @@
+package adblockr
+
+import "testing"
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		rule Rule
+		ok   bool
+		err  bool
+	}{
+		{line: ""},
+		{line: "! comment"},
+		{line: "[Adblock Plus 2.0]"},
+		{line: "# comment"},
+		{line: "0.0.0.0 ads.example.com", rule: Rule{Key: "ads.example.com"}, ok: true},
+		{line: "0.0.0.0 ads.example.com # tracker", rule: Rule{Key: "ads.example.com"}, ok: true},
+		{line: "ads.example.com", rule: Rule{Key: "ads.example.com"}, ok: true},
+		{line: "||Example.com^", rule: Rule{Key: ".example.com"}, ok: true},
+		{line: "|example.com^", rule: Rule{Key: "example.com"}, ok: true},
+		{line: "|example.com|", rule: Rule{Key: "example.com"}, ok: true},
+		{line: "example.com^", rule: Rule{Key: "*example.com"}, ok: true},
+		{line: "||ad*.example.com^", rule: Rule{Key: "{ad*.example.com,*.ad*.example.com}"}, ok: true},
+		{line: "@@||example.com^", rule: Rule{Key: ".example.com", Exception: true}, ok: true},
+		{line: "@@|example.com^", rule: Rule{Key: "example.com", Exception: true}, ok: true},
+		{line: "||example.com^$important", rule: Rule{Key: ".example.com", Important: true}, ok: true},
+		{line: `/^ad[0-9]+\.example\.com$/`, rule: Rule{Key: `/^ad[0-9]+\.example\.com$/`}, ok: true},
+		{line: `/^ads?\.$/$important`, rule: Rule{Key: `/^ads?\.$/`, Important: true}, ok: true},
+		{line: `@@/^ads\.example\.com$/`, rule: Rule{Key: `/^ads\.example\.com$/`, Exception: true}, ok: true},
+		{line: "//", err: true},
+		{line: `/^ads\./x`, err: true},
+		{line: "||example.com^$third-party", err: true},
+		{line: "||example.com/ads/banner.js", err: true},
+		{line: "||example.com^/path", err: true},
+		{line: "|https://example.com/ads^", err: true},
+		{line: "example.com##.banner", err: true},
+		{line: "example.com#@#.banner", err: true},
+		{line: "##.ad-slot"}, // a comment of a hosts file
+	}
+	for _, tt := range tests {
+		rule, ok, err := ParseRule(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRule(%q) error = %v, want error %v", tt.line, err, tt.err)
+			continue
+		}
+		if ok != tt.ok || rule != tt.rule {
+			t.Errorf("ParseRule(%q) = %+v, %v, want %+v, %v", tt.line, rule, ok, tt.rule, tt.ok)
+		}
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"||example.com^", "||example.com^"},
+		{"|example.com^", "example.com"},
+		{"@@|example.com^", "@@|example.com^"},
+		{"@@||example.com^$important", "@@||example.com^$important"},
+		{`/^ads\./`, `/^ads\./`},
+	}
+	for _, tt := range tests {
+		rule, _, err := ParseRule(tt.line)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) error = %v", tt.line, err)
+		}
+		if got := rule.String(); got != tt.want {
+			t.Errorf("ParseRule(%q).String() = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package adblockr
 
 import (
+	"crypto/tls"
 	"github.com/miekg/dns"
-	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"sync"
 	"time"
 )
 
+const (
+	resultBlocked     = "blocked"
+	resultWhitelisted = "whitelisted"
+	resultAllowed     = "allowed"
+	resultLocal       = "local"
+)
+
 const (
 	notIPQuery = 0
 	_IP4Query  = 4
@@ -20,44 +28,86 @@ var (
 	RejectTTL          uint32 = 3600
 	NullRoute                 = "0.0.0.0"
 	NullRouteV6               = "0:0:0:0:0:0:0:0"
+	OverloadRcode             = dns.RcodeServerFailure
+	RejectWithReason          = false
+	ServFailTTL        uint32 = 5
+	StaleTTL           uint32 = 30
+	CheckCNAMEs               = true
+	CheckSVCBTargets          = false
 )
 
+// maxCacheTTL caps how long any answer is kept in the cache, in seconds.
+const maxCacheTTL uint32 = 600
+
+// maxRefreshes limits the cache refreshes looking up upstream in the background at once.
+const maxRefreshes = 8
+
 type dnsRequest struct {
 	network string
 	w       dns.ResponseWriter
 	r       *dns.Msg
+	done    chan struct{}
 }
 
 type Server struct {
 	address         string
 	readTimeout     time.Duration
 	writeTimeout    time.Duration
+	workers         int
 	requestChan     chan dnsRequest
-	quit            chan struct{}
+	closed          bool
+	done            chan struct{}
+	mu              sync.RWMutex
+	listenMu        sync.Mutex
+	listenWg        sync.WaitGroup
 	blacklist       DomainBucket
 	whitelist       DomainBucket
+	clientGroups    []*ClientGroup
+	localRecords    *LocalRecords
+	ipBlacklist     *IPBucket
+	configMu        sync.RWMutex
 	resolver        Resolver
 	tcpServer       *dns.Server
 	udpServer       *dns.Server
-	cache           *cache.Cache
+	tlsServer       *dns.Server
+	tlsAddress      string
+	tlsConfig       *tls.Config
+	cache           AnswerCache
 	cacheExpire     time.Duration
 	cleanUpInterval time.Duration
+	prefetch        float64
+	prefetchHits    uint32
+	refreshSlots    chan struct{}
+	staleWindow     time.Duration
+	cacheStore      CacheStore
+	queryLog        *QueryLog
 }
 
 func NewServer(address string, resolver Resolver, blacklist DomainBucket, whitelist DomainBucket,
-	cacheExpire time.Duration, cleanUpInterval time.Duration) *Server {
+	cacheExpire time.Duration, cleanUpInterval time.Duration, workers int, queueSize int) *Server {
 	timeout := 3 * time.Second
 
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
 	srv := &Server{
-		address:      address,
-		readTimeout:  timeout,
-		writeTimeout: timeout,
-		requestChan:  make(chan dnsRequest),
-		quit:         make(chan struct{}, 1),
-		resolver:     resolver,
-		blacklist:    blacklist,
-		whitelist:    whitelist,
-		cache:        cache.New(cacheExpire, cleanUpInterval),
+		address:         address,
+		readTimeout:     timeout,
+		writeTimeout:    timeout,
+		workers:         workers,
+		requestChan:     make(chan dnsRequest, queueSize),
+		done:            make(chan struct{}),
+		resolver:        resolver,
+		blacklist:       blacklist,
+		whitelist:       whitelist,
+		cache:           newGoCache(cacheExpire, cleanUpInterval),
+		cacheExpire:     cacheExpire,
+		cleanUpInterval: cleanUpInterval,
+		refreshSlots:    make(chan struct{}, maxRefreshes),
 	}
 
 	return srv
@@ -66,186 +116,943 @@ func NewServer(address string, resolver Resolver, blacklist DomainBucket, whitel
 func (s *Server) ListenAndServe() {
 	var wg sync.WaitGroup
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s.handleRequest()
-	}()
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleRequest()
+		}()
+	}
+
+	s.listenMu.Lock()
+	tcpServer, udpServer, err := s.listen(s.address)
+	if err != nil {
+		log.WithError(err).WithField("listen", s.address).Error("unable to listen")
+	} else {
+		s.tcpServer, s.udpServer = tcpServer, udpServer
+	}
+	if s.tlsConfig != nil {
+		if err := s.listenTLS(); err != nil {
+			log.WithError(err).WithField("listen", s.tlsAddress).Error("unable to listen for tls")
+		} else {
+			log.WithField("listen", s.tlsAddress).Info("ready for tls connection")
+		}
+	}
+	s.listenMu.Unlock()
+
+	log.WithFields(log.Fields{
+		"listen":  s.address,
+		"workers": s.workers,
+		"queue":   cap(s.requestChan),
+	}).Info("ready for connection")
+	<-s.done
+	s.listenWg.Wait()
+	wg.Wait()
+	log.Info("stopped")
+}
+
+func (s *Server) listen(address string) (*dns.Server, *dns.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
 
 	tcpHandler := dns.NewServeMux()
 	tcpHandler.HandleFunc(".", s.handleTCP)
-	s.tcpServer = &dns.Server{
-		Addr:         s.address,
+	tcpServer := &dns.Server{
+		Listener:     listener,
 		Net:          "tcp",
 		Handler:      tcpHandler,
 		ReadTimeout:  s.readTimeout,
 		WriteTimeout: s.writeTimeout,
 	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := s.tcpServer.ListenAndServe(); err != nil {
-			log.WithError(err).Error("tcp server error")
-		}
-	}()
 
 	udpHandler := dns.NewServeMux()
 	udpHandler.HandleFunc(".", s.handleUDP)
-	s.udpServer = &dns.Server{
-		Addr:         s.address,
+	udpServer := &dns.Server{
+		PacketConn:   packetConn,
 		Net:          "udp",
 		Handler:      udpHandler,
 		UDPSize:      65535,
 		ReadTimeout:  s.readTimeout,
 		WriteTimeout: s.writeTimeout,
 	}
-	wg.Add(1)
+
+	s.serve(tcpServer)
+	s.serve(udpServer)
+	return tcpServer, udpServer, nil
+}
+
+// SetTLS enables DNS over TLS for downstream clients, it must be called before ListenAndServe.
+func (s *Server) SetTLS(address string, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.tlsAddress = address
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+func (s *Server) listenTLS() error {
+	listener, err := tls.Listen("tcp", s.tlsAddress, s.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	tlsHandler := dns.NewServeMux()
+	tlsHandler.HandleFunc(".", s.handleTLS)
+	s.tlsServer = &dns.Server{
+		Listener:     listener,
+		Net:          "tcp-tls",
+		Handler:      tlsHandler,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+	}
+	s.serve(s.tlsServer)
+	return nil
+}
+
+func (s *Server) serve(srv *dns.Server) {
+	s.listenWg.Add(1)
 	go func() {
-		defer wg.Done()
-		if err := s.udpServer.ListenAndServe(); err != nil {
-			log.WithError(err).Error("udp server error")
+		defer s.listenWg.Done()
+		if err := srv.ActivateAndServe(); err != nil && !s.isClosed() {
+			log.WithError(err).Error(srv.Net + " server error")
 		}
 	}()
+}
 
-	log.WithField("listen", s.address).Info("ready for connection")
-	wg.Wait()
-	log.Info("stopped")
+func stopServer(srv *dns.Server) {
+	if srv == nil {
+		return
+	}
+	_ = srv.Shutdown()
+	if srv.Listener != nil {
+		_ = srv.Listener.Close()
+	}
+	if srv.PacketConn != nil {
+		_ = srv.PacketConn.Close()
+	}
+}
+
+// SetAddress moves a running server to a new listen address,
+// the current sockets are kept when the new address can not be bound.
+func (s *Server) SetAddress(address string) error {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+
+	tcpServer, udpServer, err := s.listen(address)
+	if err != nil {
+		return err
+	}
+	stopServer(s.tcpServer)
+	stopServer(s.udpServer)
+	s.tcpServer, s.udpServer = tcpServer, udpServer
+	s.address = address
+	log.WithField("listen", address).Info("listen address changed")
+	return nil
 }
 
 func (s *Server) Shutdown() {
 	log.Debug("shutting down")
 
-	_ = s.tcpServer.Shutdown()
-	_ = s.udpServer.Shutdown()
-	close(s.quit)
+	s.listenMu.Lock()
+	stopServer(s.tcpServer)
+	stopServer(s.udpServer)
+	stopServer(s.tlsServer)
+	s.listenMu.Unlock()
+
+	s.mu.Lock()
+	closing := !s.closed
+	if closing {
+		s.closed = true
+		close(s.requestChan)
+		close(s.done)
+	}
+	s.mu.Unlock()
+
+	if closing {
+		s.saveCache()
+		closeResolver(s.Resolver())
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
 }
 
 func (s *Server) handleRequest() {
-loop:
-	for {
-		select {
-		case <-s.quit:
-			log.Debug("quit signal received")
-			break loop
-		case req, ok := <-s.requestChan:
-			if !ok {
-				break
+	for req := range s.requestChan {
+		s.processRequest(req)
+		close(req.done)
+	}
+}
+
+func (s *Server) processRequest(req dnsRequest) {
+	network, w, r := req.network, req.w, req.r
+	defer w.Close()
+	if len(r.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		s.writeReply(w, m)
+		return
+	}
+	q := r.Question[0]
+
+	clientIP := remoteIP(w.RemoteAddr())
+
+	qName := unFqdn(q.Name)
+	qType := dns.TypeToString[q.Qtype]
+	qClass := dns.ClassToString[q.Qclass]
+
+	logCtx := log.WithFields(log.Fields{
+		"net":       network,
+		"client-ip": clientIP,
+		"name":      q.Name,
+		"type":      qType,
+		"class":     qClass,
+	})
+
+	metricQueries.inc(network, qType)
+
+	entry := &QueryLogEntry{
+		Time:     time.Now(),
+		ClientIP: clientIP,
+		Network:  network,
+		Name:     q.Name,
+		Type:     qType,
+	}
+	defer s.logQuery(entry)
+
+	group := s.clientGroup(clientIP)
+	question := cacheKey(r)
+	if group != nil {
+		question = group.Name + "|" + question
+		logCtx = logCtx.WithField("group", group.Name)
+	}
+	if local, target, ok := s.LocalRecords().Answer(r); ok {
+		if target != "" {
+			if rule, blockCtx, blocked := s.resolveTarget(network, r, local, target, group, entry, logCtx); blocked {
+				metricQueryResults.inc(resultBlocked)
+				s.writeBlocked(w, r, question, isIPQuery(q), group, rule, entry, blockCtx)
+				return
 			}
-			func(network string, w dns.ResponseWriter, r *dns.Msg) {
-				defer w.Close()
-				q := r.Question[0]
-
-				var clientIP string
-				if network == "tcp" {
-					clientIP = w.RemoteAddr().(*net.TCPAddr).IP.String()
-				} else {
-					clientIP = w.RemoteAddr().(*net.UDPAddr).IP.String()
-				}
+		}
+		metricQueryResults.inc(resultLocal)
+		entry.setReply(local)
+		s.writeReply(w, local)
+		logCtx.Debug("dns query answered locally")
+		return
+	}
 
-				qName := unFqdn(q.Name)
-				qType := dns.TypeToString[q.Qtype]
-				qClass := dns.ClassToString[q.Qclass]
-
-				logCtx := log.WithFields(log.Fields{
-					"net":       network,
-					"client-ip": clientIP,
-					"name":      q.Name,
-					"type":      qType,
-					"class":     qClass,
-				})
-
-				question := qName + " " + qType + " " + qClass
-				c, found := s.cache.Get(question)
-				if found {
-					mc := c.(*dns.Msg)
-					msg := mc
-					msg.Id = r.Id
-					s.writeReply(w, msg)
+	var stale *cachedAnswer
+	if c, found := s.cache.Get(question); found && c.(*cachedAnswer).expired() {
+		stale = c.(*cachedAnswer)
+		if stale.recentlyFailed() {
+			metricQueryResults.inc(stale.result)
+			s.writeStale(w, network, r, stale, entry)
+			s.refreshStale(network, question, r, stale, group, logCtx)
+			return
+		}
+	} else if found {
+		metricCacheHits.inc()
+		answer := c.(*cachedAnswer)
+		answer.hit()
+		metricQueryResults.inc(answer.result)
+		msg := answer.reply(network, r)
+		entry.Cached = true
+		answer.logBlock(entry)
+		entry.setReply(msg)
+		s.writeReply(w, msg)
+		if answer.shouldPrefetch(s.prefetch, s.prefetchHits) {
+			r := r.Copy()
+			started := s.startRefresh(func() {
+				if err := s.refreshAnswer(network, question, r, group); err != nil {
+					answer.prefetchFailed()
+					logCtx.WithError(err).Debug("prefetch failed")
 					return
 				}
+				metricCachePrefetches.inc()
+				logCtx.Debug("dns query prefetched")
+			})
+			if !started {
+				answer.prefetchFailed()
+			}
+		}
+		return
+	}
+	metricCacheMisses.inc()
 
-				var isWhitelisted = s.whitelist.Has(qName)
-				var isBlacklisted = false
-
-				ipQuery := isIPQuery(q)
-				if ipQuery > 0 {
-
-					if !isWhitelisted {
-						isBlacklisted = s.blacklist.Has(qName)
-					}
-
-					if isBlacklisted {
-						m := new(dns.Msg)
-						m.SetReply(r)
-
-						if RejectWithNXDomain {
-							m.SetRcode(r, dns.RcodeNameError)
-						} else {
-							nullRoute := net.ParseIP(NullRoute)
-							nullRouteV6 := net.ParseIP(NullRouteV6)
-
-							switch ipQuery {
-							case _IP4Query:
-								rrHeader := dns.RR_Header{
-									Name:   q.Name,
-									Rrtype: dns.TypeA,
-									Class:  dns.ClassINET,
-									Ttl:    RejectTTL,
-								}
-								a := &dns.A{Hdr: rrHeader, A: nullRoute}
-								m.Answer = append(m.Answer, a)
-							case _IP6Query:
-								rrHeader := dns.RR_Header{
-									Name:   q.Name,
-									Rrtype: dns.TypeAAAA,
-									Class:  dns.ClassINET,
-									Ttl:    RejectTTL,
-								}
-								a := &dns.AAAA{Hdr: rrHeader, AAAA: nullRouteV6}
-								m.Answer = append(m.Answer, a)
-							}
-						}
-						s.writeReply(w, m)
-						logCtx.Warn("dns query rejected")
-						s.cache.Add(question, m, s.cacheExpire)
-						return
-					}
-				}
+	ipQuery := isIPQuery(q)
+	verdict := s.check(qName, group)
+	if verdict.Blocked && ipQuery > 0 {
+		metricQueryResults.inc(resultBlocked)
+		s.writeBlocked(w, r, question, ipQuery, group, verdict.Rule, entry, logCtx)
+		return
+	}
+	// only A and AAAA questions are blocked by name, for other types the verdict tells whether the answer is checked
+	verdict.Blocked = false
+	queryResult := verdict.result()
+	defer func() {
+		metricQueryResults.inc(queryResult)
+	}()
 
-				result, err := s.resolver.Lookup(network, r)
-				if err != nil {
-					s.handleFailed(w, r)
-					logCtx.WithError(err).Error("lookup failed")
-					return
-				}
+	result, upstream, err := s.Resolver().Lookup(network, r)
+	if err != nil && stale != nil {
+		stale.lookupFailed()
+		logCtx.WithError(err).Warn("lookup failed, serving stale answer")
+		s.writeStale(w, network, r, stale, entry)
+		return
+	}
+	if err != nil {
+		entry.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		s.handleFailed(w, r)
+		logCtx.WithError(err).Error("lookup failed")
+		if ServFailTTL > 0 {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			servFailDuration := time.Duration(ServFailTTL) * time.Second
+			s.cache.Set(question, newCachedAnswer(m, servFailDuration, queryResult), servFailDuration)
+		}
+		return
+	}
+
+	entry.Upstream = upstream
+	if !verdict.Whitelisted {
+		if hop, cloaked, ok := s.checkAnswerChain(result, group); ok {
+			queryResult = resultBlocked
+			entry.CNAME = unFqdn(hop)
+			s.writeBlocked(w, r, question, ipQuery, group, cloaked.Rule, entry, logCtx.WithField("cname", unFqdn(hop)))
+			return
+		}
+		if ip, rule, ok := s.checkAnswerIPs(result); ok {
+			queryResult = resultBlocked
+			entry.IP = ip.String()
+			s.writeBlocked(w, r, question, ipQuery, group, rule, entry, logCtx.WithField("ip", ip.String()))
+			return
+		}
+	}
+	entry.setReply(result)
+	s.writeReply(w, result)
+	logCtx.Debug("dns query success")
+
+	s.cacheResult(question, result, queryResult)
+}
+
+// writeBlocked answers a blocked query by the block mode of its client group and caches the answer.
+func (s *Server) writeBlocked(w dns.ResponseWriter, r *dns.Msg, question string, ipQuery int, group *ClientGroup,
+	rule Rule, entry *QueryLogEntry, logCtx *log.Entry) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	blockMode := BlockDefault
+	if group != nil {
+		blockMode = group.BlockMode
+	}
+	if blockMode.nxDomain() {
+		m.SetRcode(r, dns.RcodeNameError)
+	} else {
+		nullRoute := net.ParseIP(NullRoute)
+		nullRouteV6 := net.ParseIP(NullRouteV6)
+
+		switch ipQuery {
+		case _IP4Query:
+			rrHeader := dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    RejectTTL,
+			}
+			a := &dns.A{Hdr: rrHeader, A: nullRoute}
+			m.Answer = append(m.Answer, a)
+		case _IP6Query:
+			rrHeader := dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    RejectTTL,
+			}
+			a := &dns.AAAA{Hdr: rrHeader, AAAA: nullRouteV6}
+			m.Answer = append(m.Answer, a)
+		}
+	}
+	if RejectWithReason {
+		m.Extra = append(m.Extra, rejectReason(q.Name, rule))
+	}
+	entry.Rule = rule.String()
+	entry.Source = rule.Source
+	entry.setReply(m)
+	s.writeReply(w, m)
+	logCtx.WithFields(log.Fields{
+		"rule":   rule.String(),
+		"source": rule.Source,
+	}).Warn("dns query rejected")
+	answer := newCachedAnswer(m, s.cacheExpire, resultBlocked)
+	answer.rule, answer.source, answer.cname, answer.ip = entry.Rule, entry.Source, entry.CNAME, entry.IP
+	s.cache.Set(question, answer, s.cacheExpire)
+}
+
+// checkAnswerChain checks the names an upstream answer points to against the blacklist: the CNAME targets
+// with CheckCNAMEs and the targets of SVCB and HTTPS records with CheckSVCBTargets.
+// It returns the first blocked name and its verdict.
+func (s *Server) checkAnswerChain(m *dns.Msg, group *ClientGroup) (string, Verdict, bool) {
+	for _, rr := range m.Answer {
+		var target string
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			if CheckCNAMEs {
+				target = v.Target
+			}
+		case *dns.SVCB:
+			if CheckSVCBTargets {
+				target = v.Target
+			}
+		case *dns.HTTPS:
+			if CheckSVCBTargets {
+				target = v.Target
+			}
+		}
+		if target == "" || target == "." {
+			continue
+		}
+		if verdict := s.check(unFqdn(target), group); verdict.Blocked {
+			return target, verdict, true
+		}
+	}
+	return "", Verdict{}, false
+}
+
+// checkAnswerIPs checks the addresses of the A and AAAA records of an upstream answer against
+// the ip blacklist and returns the first blocked address and its rule.
+func (s *Server) checkAnswerIPs(m *dns.Msg) (net.IP, Rule, bool) {
+	ipBlacklist := s.IPBlacklist()
+	if ipBlacklist == nil {
+		return nil, Rule{}, false
+	}
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+		if rule, ok := ipBlacklist.Match(ip); ok {
+			return ip, rule, true
+		}
+	}
+	return nil, Rule{}, false
+}
+
+// cacheResult stores an upstream reply for as long as its records allow.
+func (s *Server) cacheResult(question string, result *dns.Msg, queryResult string) {
+	cacheTtl, ok := cacheTTL(result)
+	if !ok {
+		return
+	}
+	cacheDuration := time.Duration(cacheTtl) * time.Second
+	if cacheDuration.Milliseconds() > s.cacheExpire.Milliseconds() {
+		cacheDuration = s.cacheExpire
+	}
+	answer := newCachedAnswer(result, cacheDuration, queryResult)
+	if result.Rcode != dns.RcodeServerFailure {
+		answer.ttl = cacheDuration
+		s.cache.Set(question, answer, cacheDuration+s.staleWindow)
+		return
+	}
+	s.cache.Set(question, answer, cacheDuration)
+}
+
+// SetCache replaces the answer cache, it must be called before SetCacheStore and ListenAndServe.
+func (s *Server) SetCache(c AnswerCache) {
+	s.cache = c
+}
+
+// SetCacheStore restores the answers saved in store which did not expire yet,
+// the cache is saved to store again on Shutdown.
+func (s *Server) SetCacheStore(store CacheStore) {
+	s.cacheStore = store
+	items, err := store.LoadCache()
+	if err != nil {
+		log.WithError(err).Error("unable to restore answer cache")
+		return
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, item := range items {
+		if !item.Until.After(now) {
+			continue
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(item.Msg); err != nil {
+			continue
+		}
+		answer := &cachedAnswer{
+			msg:    m,
+			stored: item.Stored,
+			expire: item.Expire,
+			ttl:    item.TTL,
+			result: item.Result,
+			rule:   item.Rule,
+			source: item.Source,
+			cname:  item.CNAME,
+			ip:     item.IP,
+		}
+		if answer.result == "" {
+			answer.result = resultAllowed
+		}
+		s.cache.Set(item.Key, answer, item.Until.Sub(now))
+		restored++
+	}
+	log.WithField("entries", restored).Info("answer cache restored")
+}
 
-				s.writeReply(w, result)
-				logCtx.Debug("dns query success")
+func (s *Server) saveCache() {
+	if s.cacheStore == nil {
+		return
+	}
+	var items []CacheItem
+	for key, entry := range s.cache.Entries() {
+		answer := entry.Value.(*cachedAnswer)
+		data, err := answer.msg.Pack()
+		if err != nil {
+			continue
+		}
+		until := answer.expire
+		if !entry.Expiration.IsZero() {
+			until = entry.Expiration
+		}
+		items = append(items, CacheItem{
+			Key:    key,
+			Msg:    data,
+			Stored: answer.stored,
+			Expire: answer.expire,
+			TTL:    answer.ttl,
+			Until:  until,
+			Result: answer.result,
+			Rule:   answer.rule,
+			Source: answer.source,
+			CNAME:  answer.cname,
+			IP:     answer.ip,
+		})
+	}
+	if err := s.cacheStore.SaveCache(items); err != nil {
+		log.WithError(err).Error("unable to save answer cache")
+		return
+	}
+	log.WithField("entries", len(items)).Info("answer cache saved")
+}
 
-				var cacheTtl uint32 = 600
-				for _, answer := range result.Answer {
-					ttl := answer.Header().Ttl
-					if ttl > 0 && ttl < cacheTtl {
-						cacheTtl = ttl
-					}
+// SetServeStale keeps expired answers for window and serves them when the upstreams fail (RFC 8767),
+// a window of 0 disables serving stale answers. It must be called before ListenAndServe.
+func (s *Server) SetServeStale(window time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+	s.staleWindow = window
+}
+
+// writeStale answers with an expired cache entry.
+func (s *Server) writeStale(w dns.ResponseWriter, network string, r *dns.Msg, stale *cachedAnswer, entry *QueryLogEntry) {
+	metricCacheStale.inc()
+	msg := stale.staleReply(network, r)
+	entry.Cached = true
+	stale.logBlock(entry)
+	entry.setReply(msg)
+	s.writeReply(w, msg)
+}
+
+// refreshStale looks up an expired cache entry again in the background until the upstreams recover.
+func (s *Server) refreshStale(network string, question string, r *dns.Msg, stale *cachedAnswer,
+	group *ClientGroup, logCtx *log.Entry) {
+	if !stale.startStaleRefresh() {
+		return
+	}
+	r = r.Copy()
+	started := s.startRefresh(func() {
+		defer stale.staleRefreshDone()
+		if err := s.refreshAnswer(network, question, r, group); err != nil {
+			stale.lookupFailed()
+			logCtx.WithError(err).Debug("refreshing stale answer failed")
+			return
+		}
+		logCtx.Info("stale answer refreshed")
+	})
+	if !started {
+		stale.staleRefreshDone()
+	}
+}
+
+// SetPrefetch refreshes cached answers hit at least minHits times in the background once less than
+// threshold (a fraction of their TTL) remains, a threshold of 0 disables prefetching.
+// It must be called before ListenAndServe.
+func (s *Server) SetPrefetch(threshold float64, minHits int) {
+	if threshold < 0 {
+		threshold = 0
+	}
+	if minHits < 1 {
+		minHits = 1
+	}
+	s.prefetch = threshold
+	s.prefetchHits = uint32(minHits)
+}
+
+// startRefresh runs refresh in the background, unless maxRefreshes are running already.
+// Refreshes are dropped rather than queued so a burst of expiring answers does not flood the upstreams.
+func (s *Server) startRefresh(refresh func()) bool {
+	select {
+	case s.refreshSlots <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-s.refreshSlots }()
+		refresh()
+	}()
+	return true
+}
+
+// refreshAnswer looks up a cached question again and replaces its cache entry.
+func (s *Server) refreshAnswer(network string, question string, r *dns.Msg, group *ClientGroup) error {
+	r.Id = dns.Id()
+	result, _, err := s.Resolver().Lookup(network, r)
+	if err != nil {
+		return err
+	}
+	// the blacklist may have changed since the answer was cached
+	q := r.Question[0]
+	verdict := s.check(unFqdn(q.Name), group)
+	if verdict.Blocked && isIPQuery(q) > 0 {
+		return nil
+	}
+	verdict.Blocked = false
+	if !verdict.Whitelisted {
+		if _, _, cloaked := s.checkAnswerChain(result, group); cloaked {
+			return nil
+		}
+		if _, _, blocked := s.checkAnswerIPs(result); blocked {
+			return nil
+		}
+	}
+	s.cacheResult(question, result, verdict.result())
+	return nil
+}
+
+// cacheTTL returns how long an upstream reply may be cached in seconds. Negative answers
+// (NXDOMAIN and NODATA) use the TTL and MINIMUM of the authority SOA as in RFC 2308
+// and are not cached without one, SERVFAIL is cached for ServFailTTL. Answers with a record
+// of TTL 0 are not cached.
+func cacheTTL(m *dns.Msg) (uint32, bool) {
+	switch {
+	case m.Rcode == dns.RcodeServerFailure:
+		return ServFailTTL, ServFailTTL > 0
+	case m.Rcode == dns.RcodeNameError, m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0:
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
 				}
-				cacheDuration := time.Duration(cacheTtl) * time.Second
-				if cacheDuration.Milliseconds() > s.cacheExpire.Milliseconds() {
-					cacheDuration = s.cacheExpire
+				if ttl > maxCacheTTL {
+					ttl = maxCacheTTL
 				}
-				s.cache.Add(question, result, cacheDuration)
+				return ttl, ttl > 0
+			}
+		}
+		return 0, false
+	case m.Rcode == dns.RcodeSuccess:
+		cacheTtl := maxCacheTTL
+		for _, answer := range m.Answer {
+			if ttl := answer.Header().Ttl; ttl < cacheTtl {
+				cacheTtl = ttl
+			}
+		}
+		return cacheTtl, cacheTtl > 0
+	}
+	return 0, false
+}
+
+// cacheKey returns the cache key of a request, answers with and without DNSSEC records
+// and unvalidated answers (CD) are cached apart.
+func cacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	key := unFqdn(q.Name) + " " + dns.TypeToString[q.Qtype] + " " + dns.ClassToString[q.Qclass]
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		key += " do"
+	}
+	if r.CheckingDisabled {
+		key += " cd"
+	}
+	return key
+}
+
+func (s *Server) logQuery(entry *QueryLogEntry) {
+	if s.queryLog == nil {
+		return
+	}
+	entry.Latency = time.Since(entry.Time)
+	s.queryLog.Add(*entry)
+}
+
+// SetQueryLog enables recording every query to the query log.
+func (s *Server) SetQueryLog(queryLog *QueryLog) {
+	s.queryLog = queryLog
+}
+
+func (s *Server) enqueue(network string, w dns.ResponseWriter, r *dns.Msg) {
+	req := dnsRequest{network: network, w: w, r: r, done: make(chan struct{})}
+
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		s.handleOverload(w, r)
+		return
+	}
+	select {
+	case s.requestChan <- req:
+		s.mu.RUnlock()
+	default:
+		s.mu.RUnlock()
+		s.handleOverload(w, r)
+		log.WithField("net", network).Warn("request queue is full, dns query dropped")
+		return
+	}
+	<-req.done
+}
+
+// Verdict describes whether a domain would be blocked and by which rule.
+type Verdict struct {
+	Domain      string `json:"domain"`
+	Group       string `json:"group,omitempty"`
+	Blocked     bool   `json:"blocked"`
+	Whitelisted bool   `json:"whitelisted"`
+	Rule        Rule   `json:"-"`
+	Matched     string `json:"rule,omitempty"`
+	Source      string `json:"source,omitempty"`
+}
+
+func (v Verdict) result() string {
+	switch {
+	case v.Blocked:
+		return resultBlocked
+	case v.Whitelisted:
+		return resultWhitelisted
+	default:
+		return resultAllowed
+	}
+}
+
+// Check returns the verdict of the default policy.
+func (s *Server) Check(domain string) Verdict {
+	return s.check(domain, nil)
+}
+
+// CheckClient returns the verdict of the policy of the client group the client ip belongs to.
+func (s *Server) CheckClient(domain string, clientIP string) Verdict {
+	return s.check(domain, s.clientGroup(clientIP))
+}
+
+func (s *Server) check(domain string, group *ClientGroup) Verdict {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
 
-			}(req.network, req.w, req.r)
+	blacklist := s.blacklist
+	v := Verdict{Domain: domain}
+	if group != nil {
+		v.Group = group.Name
+		if group.Blacklist != nil {
+			blacklist = group.Blacklist
+		}
+		if group.Whitelist != nil {
+			if rule, ok := group.Whitelist.Match(domain); ok {
+				v.Whitelisted = true
+				v.Rule = rule
+			}
 		}
 	}
+	if !v.Whitelisted {
+		if rule, ok := s.whitelist.Match(domain); ok {
+			v.Whitelisted = true
+			v.Rule = rule
+		}
+	}
+	if rule, ok := blacklist.Match(domain); ok && (rule.Important || !v.Whitelisted) {
+		v.Blocked = true
+		v.Rule = rule
+	}
+	if v.Blocked || v.Whitelisted {
+		v.Matched = v.Rule.String()
+		v.Source = v.Rule.Source
+	}
+	return v
+}
+
+func (s *Server) Resolver() Resolver {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.resolver
+}
+
+// SetResolver replaces the resolver, the previous one is closed when it implements io.Closer.
+func (s *Server) SetResolver(resolver Resolver) {
+	s.configMu.Lock()
+	previous := s.resolver
+	s.resolver = resolver
+	s.configMu.Unlock()
+	closeResolver(previous)
+}
+
+func closeResolver(resolver Resolver) {
+	if closer, ok := resolver.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.WithError(err).Warn("unable to close resolver")
+		}
+	}
+}
+
+func (s *Server) Blacklist() DomainBucket {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.blacklist
+}
+
+func (s *Server) Whitelist() DomainBucket {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.whitelist
+}
+
+// SetBuckets replaces the blacklist and whitelist of a running server and flushes the cache,
+// once it returns no query is using the previous buckets anymore.
+func (s *Server) SetBuckets(blacklist DomainBucket, whitelist DomainBucket) {
+	s.configMu.Lock()
+	s.blacklist = blacklist
+	s.whitelist = whitelist
+	s.configMu.Unlock()
+	s.FlushCache()
+}
+
+// SetClientGroups replaces the client groups, a client belongs to the first group containing its ip.
+func (s *Server) SetClientGroups(groups []*ClientGroup) {
+	s.configMu.Lock()
+	s.clientGroups = groups
+	s.configMu.Unlock()
+	s.FlushCache()
+}
+
+// SetLocalRecords replaces the records answered without asking the upstreams.
+func (s *Server) SetLocalRecords(records *LocalRecords) {
+	s.configMu.Lock()
+	s.localRecords = records
+	s.configMu.Unlock()
+}
+
+func (s *Server) LocalRecords() *LocalRecords {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.localRecords
+}
+
+// SetIPBlacklist replaces the addresses and networks upstream answers are blocked for and flushes the cache.
+func (s *Server) SetIPBlacklist(ipBlacklist *IPBucket) {
+	s.configMu.Lock()
+	s.ipBlacklist = ipBlacklist
+	s.configMu.Unlock()
+	s.FlushCache()
+}
+
+func (s *Server) IPBlacklist() *IPBucket {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.ipBlacklist
+}
+
+// resolveTarget looks up the target of a local CNAME which is not local itself and adds its answers.
+// The target and its answer are filtered like any other query unless the question or the target is whitelisted,
+// it returns the blocking rule when they are blocked.
+func (s *Server) resolveTarget(network string, r *dns.Msg, m *dns.Msg, target string, group *ClientGroup,
+	entry *QueryLogEntry, logCtx *log.Entry) (Rule, *log.Entry, bool) {
+	q := r.Question[0]
+	verdict := s.check(unFqdn(target), group)
+	if verdict.Blocked && isIPQuery(q) > 0 {
+		entry.CNAME = unFqdn(target)
+		return verdict.Rule, logCtx.WithField("cname", entry.CNAME), true
+	}
+	whitelisted := verdict.Whitelisted || s.check(unFqdn(q.Name), group).Whitelisted
+
+	req := new(dns.Msg)
+	req.SetQuestion(target, q.Qtype)
+	req.CheckingDisabled = r.CheckingDisabled
+	if opt := r.IsEdns0(); opt != nil {
+		req.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	result, _, err := s.Resolver().Lookup(network, req)
+	if err != nil {
+		logCtx.WithError(err).WithField("target", target).Warn("unable to resolve local cname target")
+		return Rule{}, nil, false
+	}
+	if !whitelisted {
+		if hop, cloaked, ok := s.checkAnswerChain(result, group); ok {
+			entry.CNAME = unFqdn(hop)
+			return cloaked.Rule, logCtx.WithField("cname", entry.CNAME), true
+		}
+		if ip, rule, ok := s.checkAnswerIPs(result); ok {
+			entry.IP = ip.String()
+			return rule, logCtx.WithField("ip", entry.IP), true
+		}
+	}
+	m.Answer = append(m.Answer, result.Answer...)
+	return Rule{}, nil, false
+}
+
+func (s *Server) clientGroup(clientIP string) *ClientGroup {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	if len(s.clientGroups) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil
+	}
+	for _, group := range s.clientGroups {
+		if group.contains(ip) {
+			return group
+		}
+	}
+	return nil
+}
+
+func (s *Server) FlushCache() {
+	s.cache.Flush()
 }
 
 func (s *Server) handleTCP(w dns.ResponseWriter, r *dns.Msg) {
-	s.requestChan <- dnsRequest{network: "tcp", w: w, r: r}
+	s.enqueue("tcp", w, r)
 }
 
 func (s *Server) handleUDP(w dns.ResponseWriter, r *dns.Msg) {
-	s.requestChan <- dnsRequest{network: "udp", w: w, r: r}
+	s.enqueue("udp", w, r)
+}
+
+func (s *Server) handleTLS(w dns.ResponseWriter, r *dns.Msg) {
+	s.enqueue("tcp-tls", w, r)
 }
 
 func (s *Server) writeReply(w dns.ResponseWriter, r *dns.Msg) {
@@ -265,6 +1072,29 @@ func (s *Server) handleFailed(w dns.ResponseWriter, r *dns.Msg) {
 	s.writeReply(w, m)
 }
 
+func (s *Server) handleOverload(w dns.ResponseWriter, r *dns.Msg) {
+	defer w.Close()
+	m := new(dns.Msg)
+	m.SetRcode(r, OverloadRcode)
+	s.writeReply(w, m)
+}
+
+func rejectReason(name string, rule Rule) dns.RR {
+	txt := []string{"blocked by " + rule.String()}
+	if rule.Source != "" {
+		txt = append(txt, "source "+rule.Source)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    RejectTTL,
+		},
+		Txt: txt,
+	}
+}
+
 func isIPQuery(q dns.Question) int {
 	if q.Qclass != dns.ClassINET {
 		return notIPQuery
@@ -279,6 +1109,21 @@ func isIPQuery(q dns.Question) int {
 	}
 }
 
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		return host
+	}
+}
+
 func unFqdn(s string) string {
 	if dns.IsFqdn(s) {
 		return s[:len(s)-1]
@@ -0,0 +1,211 @@
+package adblockr
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubResolver answers every question with the records of its name.
+type stubResolver map[string][]string
+
+func (r stubResolver) Lookup(net string, req *dns.Msg) (*dns.Msg, string, error) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for _, record := range r[req.Question[0].Name] {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, "", err
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m, "stub", nil
+}
+
+// testResponseWriter keeps the reply written to it.
+type testResponseWriter struct {
+	msg *dns.Msg
+}
+
+var testAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+func (w *testResponseWriter) LocalAddr() net.Addr         { return testAddr }
+func (w *testResponseWriter) RemoteAddr() net.Addr        { return testAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+func newTestServer(resolver Resolver, blacklist []string, whitelist []string) *Server {
+	black, white := NewMemDomainBucket(), NewMemDomainBucket()
+	for _, entry := range blacklist {
+		rule, _, _ := ParseRule(entry)
+		black.Put(rule)
+	}
+	for _, entry := range whitelist {
+		rule, _, _ := ParseRule(entry)
+		rule.Exception = true
+		white.Put(rule)
+	}
+	return NewServer("127.0.0.1:0", resolver, black, white, time.Minute, time.Minute, 1, 0)
+}
+
+func query(s *Server, name string, qType uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qType)
+	w := &testResponseWriter{}
+	s.processRequest(dnsRequest{network: "udp", w: w, r: r})
+	return w.msg
+}
+
+func TestProcessRequestCNAMECloaking(t *testing.T) {
+	resolver := stubResolver{
+		"good.example.com.": {
+			"good.example.com. 60 IN CNAME cdn.tracker.net.",
+			"cdn.tracker.net. 60 IN A 192.0.2.1",
+		},
+		"metrics.example.com.": {
+			"metrics.example.com. 60 IN CNAME cdn.tracker.net.",
+			"cdn.tracker.net. 60 IN A 192.0.2.1",
+		},
+	}
+	s := newTestServer(resolver, []string{"||tracker.net^"}, []string{"good.example.com"})
+
+	tests := []struct {
+		name    string
+		qType   uint16
+		blocked bool
+	}{
+		{"good.example.com", dns.TypeA, false},
+		{"good.example.com", dns.TypeHTTPS, false},
+		{"good.example.com", dns.TypeTXT, false},
+		{"metrics.example.com", dns.TypeA, true},
+		{"metrics.example.com", dns.TypeHTTPS, true},
+	}
+	for _, tt := range tests {
+		m := query(s, tt.name, tt.qType)
+		if m == nil {
+			t.Fatalf("%s %s: no reply", tt.name, dns.TypeToString[tt.qType])
+		}
+		blocked := true
+		for _, rr := range m.Answer {
+			if _, ok := rr.(*dns.CNAME); ok {
+				blocked = false
+			}
+		}
+		if blocked != tt.blocked {
+			t.Errorf("%s %s: blocked = %v, want %v, answer %v", tt.name, dns.TypeToString[tt.qType], blocked, tt.blocked, m.Answer)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	soa := func(ttl, minttl uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: minttl,
+		}
+	}
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}
+	}
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		ttl    uint32
+		ok     bool
+	}{
+		{"lowest answer ttl", dns.RcodeSuccess, []dns.RR{a(300), a(60)}, nil, 60, true},
+		{"capped answer ttl", dns.RcodeSuccess, []dns.RR{a(86400)}, nil, maxCacheTTL, true},
+		{"zero answer ttl", dns.RcodeSuccess, []dns.RR{a(0)}, nil, 0, false},
+		{"one zero answer ttl", dns.RcodeSuccess, []dns.RR{a(300), a(0)}, nil, 0, false},
+		{"nxdomain soa minimum", dns.RcodeNameError, nil, []dns.RR{soa(3600, 120)}, 120, true},
+		{"nxdomain soa ttl", dns.RcodeNameError, nil, []dns.RR{soa(30, 120)}, 30, true},
+		{"nxdomain capped", dns.RcodeNameError, nil, []dns.RR{soa(86400, 86400)}, maxCacheTTL, true},
+		{"nxdomain without soa", dns.RcodeNameError, nil, nil, 0, false},
+		{"nodata soa", dns.RcodeSuccess, nil, []dns.RR{soa(300, 60)}, 60, true},
+		{"nodata without soa", dns.RcodeSuccess, nil, nil, 0, false},
+		{"servfail", dns.RcodeServerFailure, nil, nil, ServFailTTL, ServFailTTL > 0},
+		{"refused", dns.RcodeRefused, nil, nil, 0, false},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.Rcode = tt.rcode
+		m.Answer = tt.answer
+		m.Ns = tt.ns
+		ttl, ok := cacheTTL(m)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("%s: cacheTTL() = %d, %v, want %d, %v", tt.name, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestStartRefreshDropsWhenBusy(t *testing.T) {
+	s := newTestServer(stubResolver{}, nil, nil)
+	release := make(chan struct{})
+	for i := 0; i < maxRefreshes; i++ {
+		if !s.startRefresh(func() { <-release }) {
+			t.Fatalf("refresh %d not started", i)
+		}
+	}
+	if s.startRefresh(func() {}) {
+		t.Error("refresh started while all slots are busy")
+	}
+	close(release)
+
+	done := make(chan struct{})
+	for !s.startRefresh(func() { close(done) }) {
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+}
+
+func TestProcessRequestLocalCNAMETarget(t *testing.T) {
+	resolver := stubResolver{
+		"www.example.com.": {"www.example.com. 60 IN A 192.0.2.1"},
+		"cdn.example.com.": {
+			"cdn.example.com. 60 IN CNAME edge.tracker.net.",
+			"edge.tracker.net. 60 IN A 192.0.2.2",
+		},
+		"ads.example.com.": {"ads.example.com. 60 IN A 192.0.2.3"},
+	}
+	s := newTestServer(resolver, []string{"||tracker.net^", "ads.example.com"}, []string{"allowed.lan"})
+	records := NewLocalRecords()
+	for _, record := range []string{
+		"www.lan. CNAME www.example.com.",
+		"cdn.lan. CNAME cdn.example.com.",
+		"ads.lan. CNAME ads.example.com.",
+		"allowed.lan. CNAME cdn.example.com.",
+	} {
+		if err := records.AddRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetLocalRecords(records)
+
+	tests := []struct {
+		name    string
+		answers int
+		blocked bool
+	}{
+		{"www.lan", 2, false},
+		{"cdn.lan", 0, true},
+		{"ads.lan", 0, true},
+		{"allowed.lan", 3, false},
+	}
+	for _, tt := range tests {
+		m := query(s, tt.name, dns.TypeA)
+		blocked := len(m.Answer) == 1 && m.Answer[0].(*dns.A).A.Equal(net.ParseIP(NullRoute))
+		if blocked != tt.blocked || !blocked && len(m.Answer) != tt.answers {
+			t.Errorf("%s: answer %v, want blocked %v", tt.name, m.Answer, tt.blocked)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package adblockr
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// unhealthyFailures is the number of consecutive failures after which an upstream is skipped.
+	unhealthyFailures = 3
+	// healthProbeInterval is how often every upstream is probed in the background.
+	healthProbeInterval = 30 * time.Second
+	// rttWeight is the weight of a new sample in the moving average of the round trip time.
+	rttWeight = 0.2
+)
+
+// UpstreamStatus is the health of an upstream nameserver as seen by a resolver.
+type UpstreamStatus struct {
+	Upstream string
+	Healthy  bool
+	RTT      time.Duration
+	Failures int
+}
+
+// HealthReporter is implemented by resolvers which track the health of their upstreams.
+type HealthReporter interface {
+	Health() []UpstreamStatus
+}
+
+type upstreamState struct {
+	rtt      time.Duration
+	failures int
+	healthy  bool
+	probing  bool
+}
+
+// upstreamHealth tracks the latency and errors of every upstream from live queries and from
+// probes sent in the background, so an unhealthy upstream is noticed when it answers again.
+type upstreamHealth struct {
+	mu          sync.Mutex
+	nameservers []string
+	states      map[string]*upstreamState
+	probe       func(nameserver string) error
+	quit        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newUpstreamHealth(nameservers []string, probe func(nameserver string) error) *upstreamHealth {
+	h := &upstreamHealth{
+		nameservers: nameservers,
+		states:      make(map[string]*upstreamState),
+		probe:       probe,
+		quit:        make(chan struct{}),
+	}
+	for _, ns := range nameservers {
+		h.states[ns] = &upstreamState{healthy: true}
+	}
+	return h
+}
+
+// start probes every upstream each healthProbeInterval until stop is called.
+func (h *upstreamHealth) start() {
+	go func() {
+		ticker := time.NewTicker(healthProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.quit:
+				return
+			case <-ticker.C:
+				h.probeAll()
+			}
+		}
+	}()
+}
+
+func (h *upstreamHealth) stop() {
+	h.stopOnce.Do(func() {
+		close(h.quit)
+	})
+}
+
+// probeAll starts a probe for every upstream whose previous probe finished.
+func (h *upstreamHealth) probeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ns := range h.nameservers {
+		if state := h.states[ns]; !state.probing {
+			state.probing = true
+			go h.runProbe(ns)
+		}
+	}
+}
+
+func (h *upstreamHealth) success(nameserver string, rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.states[nameserver]
+	if !ok {
+		return
+	}
+	if state.rtt == 0 {
+		state.rtt = rtt
+	} else {
+		state.rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(state.rtt))
+	}
+	state.failures = 0
+	if !state.healthy {
+		state.healthy = true
+		log.WithFields(log.Fields{"ns": nameserver, "rtt": state.rtt}).Info("upstream is healthy again")
+	}
+}
+
+func (h *upstreamHealth) failure(nameserver string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.states[nameserver]
+	if !ok {
+		return
+	}
+	state.failures++
+	if state.healthy && state.failures >= unhealthyFailures {
+		state.healthy = false
+		log.WithFields(log.Fields{"ns": nameserver, "failures": state.failures}).Warn("upstream marked unhealthy")
+	}
+}
+
+// split returns the healthy and the unhealthy upstreams in their configured order.
+func (h *upstreamHealth) split() ([]string, []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	healthy := make([]string, 0, len(h.nameservers))
+	var unhealthy []string
+	for _, ns := range h.nameservers {
+		state := h.states[ns]
+		if state.healthy {
+			healthy = append(healthy, ns)
+			continue
+		}
+		unhealthy = append(unhealthy, ns)
+	}
+	return healthy, unhealthy
+}
+
+// rtt returns the moving average round trip time of an upstream, zero until it answered once.
+func (h *upstreamHealth) rtt(nameserver string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.states[nameserver]; ok {
+		return state.rtt
+	}
+	return 0
+}
+
+func (h *upstreamHealth) runProbe(nameserver string) {
+	start := time.Now()
+	err := h.probe(nameserver)
+
+	h.mu.Lock()
+	h.states[nameserver].probing = false
+	h.mu.Unlock()
+
+	if err != nil {
+		log.WithField("ns", nameserver).WithError(err).Debug("upstream probe failed")
+		h.failure(nameserver)
+		return
+	}
+	h.success(nameserver, time.Since(start))
+}
+
+func (h *upstreamHealth) status() []UpstreamStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := make([]UpstreamStatus, 0, len(h.nameservers))
+	for _, ns := range h.nameservers {
+		state := h.states[ns]
+		status = append(status, UpstreamStatus{
+			Upstream: ns,
+			Healthy:  state.healthy,
+			RTT:      state.rtt,
+			Failures: state.failures,
+		})
+	}
+	return status
+}
@@ -0,0 +1,59 @@
+package adblockr
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	var mu sync.Mutex
+	down := map[string]bool{"b:53": true}
+	probed := make(chan string, 3)
+	h := newUpstreamHealth([]string{"a:53", "b:53", "c:53"}, func(ns string) error {
+		defer func() { probed <- ns }()
+		mu.Lock()
+		defer mu.Unlock()
+		if down[ns] {
+			return fmt.Errorf("timeout")
+		}
+		return nil
+	})
+
+	for i := 0; i < unhealthyFailures-1; i++ {
+		h.failure("b:53")
+	}
+	if healthy, _ := h.split(); len(healthy) != 3 {
+		t.Fatalf("healthy = %v after %d failures, want all", healthy, unhealthyFailures-1)
+	}
+	h.failure("b:53")
+	healthy, unhealthy := h.split()
+	if fmt.Sprint(healthy) != "[a:53 c:53]" || fmt.Sprint(unhealthy) != "[b:53]" {
+		t.Fatalf("split() = %v, %v, want [a:53 c:53], [b:53]", healthy, unhealthy)
+	}
+
+	mu.Lock()
+	down["b:53"] = false
+	mu.Unlock()
+	h.probeAll()
+	for i := 0; i < 3; i++ {
+		<-probed
+	}
+	// the probe result is recorded right after the probe function returns
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, unhealthy = h.split(); len(unhealthy) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(unhealthy) != 0 {
+		t.Errorf("unhealthy = %v after a successful probe, want none", unhealthy)
+	}
+	for _, status := range h.status() {
+		if status.Failures != 0 || status.RTT == 0 {
+			t.Errorf("status %+v after a successful probe, want no failures and a round trip time", status)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package adblockr
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides in which order the upstream nameservers are asked.
+type Strategy int
+
+const (
+	// StrategySequential asks the upstreams in their configured order, the next one after each interval.
+	StrategySequential Strategy = iota
+	// StrategyParallel asks every upstream at once and takes the first valid answer.
+	StrategyParallel
+	// StrategyRoundRobin starts with the next upstream on every query.
+	StrategyRoundRobin
+	// StrategyRandom starts with an upstream picked at random by its weight.
+	StrategyRandom
+	// StrategyFastest starts with the upstream of the lowest moving average round trip time.
+	StrategyFastest
+)
+
+func ParseStrategy(strategy string) (Strategy, error) {
+	switch strings.ToLower(strategy) {
+	case "", "sequential":
+		return StrategySequential, nil
+	case "parallel":
+		return StrategyParallel, nil
+	case "round_robin", "roundrobin":
+		return StrategyRoundRobin, nil
+	case "random", "weighted_random":
+		return StrategyRandom, nil
+	case "fastest", "lowest_latency":
+		return StrategyFastest, nil
+	default:
+		return StrategySequential, fmt.Errorf("invalid upstream strategy: %s", strategy)
+	}
+}
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyParallel:
+		return "parallel"
+	case StrategyRoundRobin:
+		return "round_robin"
+	case StrategyRandom:
+		return "random"
+	case StrategyFastest:
+		return "fastest"
+	default:
+		return "sequential"
+	}
+}
+
+// upstreamSelector orders the healthy upstreams of a resolver by its strategy.
+type upstreamSelector struct {
+	strategy Strategy
+	weights  map[string]int
+	next     uint32
+	randMu   sync.Mutex
+	rand     *rand.Rand
+}
+
+func newUpstreamSelector(strategy Strategy, weights map[string]int) *upstreamSelector {
+	return &upstreamSelector{
+		strategy: strategy,
+		weights:  weights,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *upstreamSelector) order(healthy []string, health *upstreamHealth) []string {
+	if len(healthy) < 2 {
+		return healthy
+	}
+	switch s.strategy {
+	case StrategyRoundRobin:
+		first := int((atomic.AddUint32(&s.next, 1) - 1) % uint32(len(healthy)))
+		ordered := make([]string, 0, len(healthy))
+		ordered = append(ordered, healthy[first:]...)
+		return append(ordered, healthy[:first]...)
+	case StrategyRandom:
+		first := s.pick(healthy)
+		ordered := make([]string, 0, len(healthy))
+		ordered = append(ordered, healthy[first])
+		ordered = append(ordered, healthy[:first]...)
+		return append(ordered, healthy[first+1:]...)
+	case StrategyFastest:
+		// upstreams without a round trip time yet come first to get measured
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return health.rtt(healthy[i]) < health.rtt(healthy[j])
+		})
+	}
+	return healthy
+}
+
+// pick returns the index of a random upstream, an upstream without a weight counts as 1.
+func (s *upstreamSelector) pick(upstreams []string) int {
+	total := 0
+	for _, ns := range upstreams {
+		total += s.weight(ns)
+	}
+	s.randMu.Lock()
+	n := s.rand.Intn(total)
+	s.randMu.Unlock()
+	for i, ns := range upstreams {
+		n -= s.weight(ns)
+		if n < 0 {
+			return i
+		}
+	}
+	return len(upstreams) - 1
+}
+
+func (s *upstreamSelector) weight(nameserver string) int {
+	if w, ok := s.weights[nameserver]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,94 @@
+package adblockr
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     Strategy
+		err      bool
+	}{
+		{"", StrategySequential, false},
+		{"sequential", StrategySequential, false},
+		{"Parallel", StrategyParallel, false},
+		{"round_robin", StrategyRoundRobin, false},
+		{"roundrobin", StrategyRoundRobin, false},
+		{"weighted_random", StrategyRandom, false},
+		{"lowest_latency", StrategyFastest, false},
+		{"fastest", StrategyFastest, false},
+		{"broadcast", StrategySequential, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.strategy)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseStrategy(%q) = %v, %v, want %v, error %v", tt.strategy, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestUpstreamSelectorOrder(t *testing.T) {
+	upstreams := []string{"a:53", "b:53", "c:53"}
+	health := newUpstreamHealth(upstreams, nil)
+	health.success("a:53", 30*time.Millisecond)
+	health.success("c:53", 10*time.Millisecond)
+
+	tests := []struct {
+		name     string
+		strategy Strategy
+		want     []string
+	}{
+		{"sequential", StrategySequential, []string{"[a:53 b:53 c:53]", "[a:53 b:53 c:53]"}},
+		{"round robin", StrategyRoundRobin, []string{"[a:53 b:53 c:53]", "[b:53 c:53 a:53]", "[c:53 a:53 b:53]", "[a:53 b:53 c:53]"}},
+		{"fastest", StrategyFastest, []string{"[b:53 c:53 a:53]"}},
+	}
+	for _, tt := range tests {
+		s := newUpstreamSelector(tt.strategy, nil)
+		for i, want := range tt.want {
+			healthy := append([]string(nil), upstreams...)
+			if got := fmt.Sprint(s.order(healthy, health)); got != want {
+				t.Errorf("%s: order %d = %s, want %s", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestUpstreamSelectorRoundRobinWraps(t *testing.T) {
+	s := newUpstreamSelector(StrategyRoundRobin, nil)
+	s.next = ^uint32(0)
+	healthy := []string{"a:53", "b:53", "c:53"}
+	// the counter wraps from 4294967295, which is 0 modulo 3, to 0
+	for _, want := range []string{"[a:53 b:53 c:53]", "[a:53 b:53 c:53]", "[b:53 c:53 a:53]"} {
+		if got := fmt.Sprint(s.order(healthy, nil)); got != want {
+			t.Errorf("order = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestUpstreamSelectorRandomWeights(t *testing.T) {
+	tests := []struct {
+		weights map[string]int
+		want    map[string]bool
+	}{
+		{nil, map[string]bool{"a:53": true, "b:53": true, "c:53": true}},
+		{map[string]int{"a:53": 1000000000, "b:53": 1, "c:53": 1}, map[string]bool{"a:53": true}},
+		{map[string]int{"a:53": 0, "b:53": -1, "c:53": 1000000000}, map[string]bool{"c:53": true}},
+	}
+	for _, tt := range tests {
+		s := newUpstreamSelector(StrategyRandom, tt.weights)
+		first := make(map[string]bool)
+		for i := 0; i < 300; i++ {
+			ordered := s.order([]string{"a:53", "b:53", "c:53"}, nil)
+			if len(ordered) != 3 {
+				t.Fatalf("weights %v: order = %v, want every upstream", tt.weights, ordered)
+			}
+			first[ordered[0]] = true
+		}
+		if fmt.Sprint(first) != fmt.Sprint(tt.want) {
+			t.Errorf("weights %v: first upstreams %v, want %v", tt.weights, first, tt.want)
+		}
+	}
+}